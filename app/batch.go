@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// job is an input file of a command and its output file.
+type job struct {
+	in, out string
+}
+
+// batchFlags are the flags of commands that take many input files.
+type batchFlags struct {
+	outPath   *string
+	outDir    *string
+	recursive *bool
+	workers   *int
+	overwrite *bool
+	update    *bool
+}
+
+func addBatchFlags(fs *flag.FlagSet, outExt string) *batchFlags {
+	return &batchFlags{
+		outPath:   fs.String("o", "", "path to output file of a single input, default is the input with its extension replaced by "+outExt),
+		outDir:    fs.String("outdir", "", "directory of the outputs, mirroring the input directories"),
+		recursive: fs.Bool("R", false, "process directories recursively"),
+		workers:   fs.Int("j", runtime.NumCPU(), "number of files processed in parallel"),
+		overwrite: fs.Bool("f", false, "force overwrite existing files"),
+		update:    fs.Bool("u", false, "skip inputs whose output is newer, and overwrite the other outputs"),
+	}
+}
+
+// Expands the input arguments into jobs.
+// An argument is a file, a glob or a directory, whose files with one of exts
+// are the inputs. The output of an input is named by replacing its extension
+// with outExt, and is placed in the output directory if there is one,
+// at the same path relative to it as the input is relative to the directory argument.
+func (b *batchFlags) jobs(flags *flag.FlagSet, args, exts []string, outExt string) ([]job, error) {
+	if len(args) == 0 {
+		return nil, newUsageError(flags, "no input file specified")
+	}
+	if *b.workers < 1 {
+		return nil, newUsageError(flags, "invalid number of workers")
+	}
+
+	// Standard input is the only input, and is written to standard output by default.
+	for _, arg := range args {
+		if arg == stdio {
+			if len(args) > 1 {
+				return nil, newUsageError(flags, "- must be the only input")
+			}
+			out := stdio
+			if *b.outPath != "" {
+				out = *b.outPath
+			}
+			return []job{{stdio, out}}, nil
+		}
+	}
+
+	var jobs []job
+	add := func(path, root string) {
+		out := defaultOutput(path, outExt)
+		if *b.outDir != "" {
+			rel, err := filepath.Rel(root, out)
+			if err != nil || strings.HasPrefix(rel, "..") {
+				rel = filepath.Base(out)
+			}
+			out = filepath.Join(*b.outDir, rel)
+		}
+		jobs = append(jobs, job{path, out})
+	}
+
+	for _, arg := range args {
+		paths := []string{arg}
+		if strings.ContainsAny(arg, "*?[") {
+			matches, err := filepath.Glob(arg)
+			if err != nil {
+				return nil, err
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files match %v", arg)
+			}
+			paths = matches
+		}
+
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				add(path, filepath.Dir(path))
+				continue
+			}
+
+			err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if d.IsDir() {
+					if p != path && !*b.recursive {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if hasExt(p, exts) {
+					add(p, path)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(jobs) == 0 {
+		return nil, errors.New("no input files found")
+	}
+	if *b.outPath != "" {
+		if len(jobs) > 1 {
+			return nil, newUsageError(flags, "-o can only be used with a single input file")
+		}
+		jobs[0].out = *b.outPath
+	}
+
+	// Inputs with the same output would overwrite each other, as happens
+	// when globs of different directories are flattened into the output directory.
+	ins := make(map[string]string, len(jobs))
+	for _, j := range jobs {
+		out := filepath.Clean(j.out)
+		if in, ok := ins[out]; ok {
+			return nil, newUsageError(flags, fmt.Sprintf("%v and %v have the same output %v", in, j.in, j.out))
+		}
+		ins[out] = j.in
+	}
+	return jobs, nil
+}
+
+func hasExt(path string, exts []string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, e := range exts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// Outcomes of a job.
+const (
+	jobDone = iota
+	jobFailed
+	jobSkipped
+)
+
+// Runs process on every job in parallel.
+// A single job behaves as if there were no batch:
+// it asks before overwriting its output and reports only the error.
+// Otherwise existing outputs are never overwritten without -f or -u,
+// every failure is reported as it happens and a summary is printed at the end.
+func (b *batchFlags) run(jobs []job, process func(in, out string) error) error {
+	if len(jobs) == 1 {
+		j := jobs[0]
+		if *b.update && upToDate(j) {
+			fmt.Fprintf(os.Stderr, "%v is up to date\n", j.out)
+			return nil
+		}
+		force := *b.overwrite || *b.update
+		if j.in == stdio && !force {
+			// The answer cannot be read from standard input.
+			if _, err := os.Stat(j.out); err == nil && j.out != stdio {
+				return fmt.Errorf("%v already exists, use -f to overwrite", j.out)
+			}
+		}
+		if err := checkOverwrite(j.out, force); err != nil {
+			return err
+		}
+		if err := mkdirFor(j.out); err != nil {
+			return err
+		}
+		return process(j.in, j.out)
+	}
+
+	outcomes := make([]int, len(jobs))
+	var mu sync.Mutex
+	do := func(j job) int {
+		if *b.update && upToDate(j) {
+			return jobSkipped
+		}
+		err := func() error {
+			if !*b.overwrite && !*b.update {
+				if _, err := os.Stat(j.out); err == nil {
+					return fmt.Errorf("%v already exists", j.out)
+				}
+			}
+			if err := mkdirFor(j.out); err != nil {
+				return err
+			}
+			return process(j.in, j.out)
+		}()
+		if err != nil {
+			mu.Lock()
+			fmt.Fprintf(os.Stderr, "%v: %v\n", j.in, err)
+			mu.Unlock()
+			return jobFailed
+		}
+		return jobDone
+	}
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < *b.workers && w < len(jobs); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				outcomes[i] = do(jobs[i])
+			}
+		}()
+	}
+	for i := range jobs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	var counts [3]int
+	var inSize, outSize int64
+	for i, o := range outcomes {
+		counts[o]++
+		if o == jobFailed {
+			continue
+		}
+		inSize += fileSize(jobs[i].in)
+		outSize += fileSize(jobs[i].out)
+	}
+	fmt.Fprintf(os.Stderr, "%v files: %v done, %v failed, %v up to date\n", len(jobs), counts[jobDone], counts[jobFailed], counts[jobSkipped])
+	if inSize > 0 {
+		fmt.Fprintf(os.Stderr, "input: %dk output: %dk ratio: %.3f\n", inSize/1000, outSize/1000, float64(outSize)/float64(inSize))
+	}
+	if counts[jobFailed] > 0 {
+		return fmt.Errorf("%v of %v files failed", counts[jobFailed], len(jobs))
+	}
+	return nil
+}
+
+// Returns whether the output of j was modified after its input.
+func upToDate(j job) bool {
+	in, err := os.Stat(j.in)
+	if err != nil {
+		return false
+	}
+	out, err := os.Stat(j.out)
+	if err != nil {
+		return false
+	}
+	return !out.ModTime().Before(in.ModTime())
+}
+
+func mkdirFor(path string) error {
+	dir := filepath.Dir(path)
+	if path == stdio || dir == "." {
+		return nil
+	}
+	return os.MkdirAll(dir, 0755)
+}
+
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sinacam/gshe"
+)
+
+// Returns the batch flags parsed from args.
+func parseBatchFlags(t *testing.T, args ...string) (*flag.FlagSet, *batchFlags) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	b := addBatchFlags(fs, ".gsc")
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return fs, b
+}
+
+// Creates the files relative to dir with their contents.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Returns what f writes to standard error.
+func captureStderr(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+	defer func() { os.Stderr = stderr }()
+
+	done := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		done <- data
+	}()
+	f()
+	w.Close()
+	return string(<-done)
+}
+
+func TestBatchJobs(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.gse":          "",
+		"b.GSE":          "",
+		"c.txt":          "",
+		"sub/d.gse":      "",
+		"sub/deep/e.gse": "",
+	})
+	in := func(name string) string { return filepath.Join(dir, name) }
+	out := filepath.Join(dir, "out")
+
+	cases := []struct {
+		name   string
+		flags  []string
+		args   []string
+		expect []job
+		err    string
+	}{
+		{"file", nil, []string{in("a.gse")},
+			[]job{{in("a.gse"), in("a.gsc")}}, ""},
+		{"file -o", []string{"-o", in("x.gsc")}, []string{in("a.gse")},
+			[]job{{in("a.gse"), in("x.gsc")}}, ""},
+		{"glob", nil, []string{in("*.gse")},
+			[]job{{in("a.gse"), in("a.gsc")}}, ""},
+		{"glob without matches", nil, []string{in("*.png")}, nil, "no files match"},
+		{"directory", nil, []string{dir},
+			[]job{{in("a.gse"), in("a.gsc")}, {in("b.GSE"), in("b.gsc")}}, ""},
+		{"directory -R", []string{"-R"}, []string{dir},
+			[]job{
+				{in("a.gse"), in("a.gsc")},
+				{in("b.GSE"), in("b.gsc")},
+				{in("sub/d.gse"), in("sub/d.gsc")},
+				{in("sub/deep/e.gse"), in("sub/deep/e.gsc")},
+			}, ""},
+		{"directory -R -outdir", []string{"-R", "-outdir", out}, []string{in("sub")},
+			[]job{
+				{in("sub/d.gse"), filepath.Join(out, "d.gsc")},
+				{in("sub/deep/e.gse"), filepath.Join(out, "deep/e.gsc")},
+			}, ""},
+		{"file -outdir", []string{"-outdir", out}, []string{in("sub/deep/e.gse")},
+			[]job{{in("sub/deep/e.gse"), filepath.Join(out, "e.gsc")}}, ""},
+		{"many -o", []string{"-o", in("x.gsc")}, []string{dir}, nil, "-o can only be used with a single input file"},
+		{"files and directories", nil, []string{in("sub/deep/e.gse"), filepath.Join(dir, "sub")},
+			[]job{{in("sub/deep/e.gse"), in("sub/deep/e.gsc")}, {in("sub/d.gse"), in("sub/d.gsc")}}, ""},
+		{"no inputs", nil, nil, nil, "no input file specified"},
+		{"nested directory", nil, []string{in("sub/deep")}, []job{{in("sub/deep/e.gse"), in("sub/deep/e.gsc")}}, ""},
+		{"missing file", nil, []string{in("missing.gse")}, nil, "no such file"},
+		{"no workers", []string{"-j", "0"}, []string{in("a.gse")}, nil, "invalid number of workers"},
+	}
+
+	for _, c := range cases {
+		fs, b := parseBatchFlags(t, c.flags...)
+		jobs, err := b.jobs(fs, c.args, []string{".gse"}, ".gsc")
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("%v\nexpect: %v\ngot: %v", c.name, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		if len(jobs) != len(c.expect) {
+			t.Fatalf("%v\nexpect: %v\ngot: %v", c.name, c.expect, jobs)
+		}
+		for i := range jobs {
+			if jobs[i] != c.expect[i] {
+				t.Fatalf("%v\nexpect: %v\ngot: %v", c.name, c.expect, jobs)
+			}
+		}
+	}
+
+	// A directory without inputs is an error.
+	fs, b := parseBatchFlags(t)
+	if _, err := b.jobs(fs, []string{t.TempDir()}, []string{".gse"}, ".gsc"); err == nil || !strings.Contains(err.Error(), "no input files found") {
+		t.Fatalf("\nexpect: %v\ngot: %v", "no input files found", err)
+	}
+
+	// Globs of different directories flattened into the same outputs are a usage error.
+	dir = t.TempDir()
+	writeFiles(t, dir, map[string]string{"a/x.gse": "", "b/x.gse": ""})
+	fs, b = parseBatchFlags(t, "-outdir", out)
+	_, err := b.jobs(fs, []string{in("a/*.gse"), in("b/*.gse")}, []string{".gse"}, ".gsc")
+	var uerr *usageError
+	if !errors.As(err, &uerr) || !strings.Contains(err.Error(), "same output") {
+		t.Fatalf("\nexpect: %v\ngot: %v", "same output", err)
+	}
+}
+
+// Copies the input to the output, failing for inputs named bad.
+func copyProcess(in, out string) error {
+	if strings.HasPrefix(filepath.Base(in), "bad") {
+		return gshe.ErrWrongKey
+	}
+	data, err := ioutil.ReadFile(in)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(out, data, 0644)
+}
+
+func readFile(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestBatchRun(t *testing.T) {
+	old := time.Now().Add(-time.Hour)
+	cases := []struct {
+		name    string
+		flags   []string
+		files   map[string]string
+		outdir  bool
+		summary string
+		err     string
+		expect  map[string]string // outputs afterwards
+	}{
+		{
+			name:    "new outputs",
+			files:   map[string]string{"a.gse": "a", "b.gse": "b", "c.gse": "c"},
+			summary: "3 files: 3 done, 0 failed, 0 up to date",
+			expect:  map[string]string{"a.gsc": "a", "b.gsc": "b", "c.gsc": "c"},
+		},
+		{
+			name:    "existing outputs are not overwritten",
+			files:   map[string]string{"a.gse": "a", "b.gse": "b", "b.gsc": "old"},
+			summary: "2 files: 1 done, 1 failed, 0 up to date",
+			err:     "1 of 2 files failed",
+			expect:  map[string]string{"a.gsc": "a", "b.gsc": "old"},
+		},
+		{
+			name:    "-f overwrites",
+			flags:   []string{"-f"},
+			files:   map[string]string{"a.gse": "a", "b.gse": "b", "b.gsc": "old"},
+			summary: "2 files: 2 done, 0 failed, 0 up to date",
+			expect:  map[string]string{"a.gsc": "a", "b.gsc": "b"},
+		},
+		{
+			name:    "-u skips newer outputs",
+			flags:   []string{"-u"},
+			files:   map[string]string{"a.gse": "a", "b.gse": "b", "b.gsc": "new", "c.gse": "c", "c.gsc": "stale"},
+			summary: "3 files: 2 done, 0 failed, 1 up to date",
+			expect:  map[string]string{"a.gsc": "a", "b.gsc": "new", "c.gsc": "c"},
+		},
+		{
+			name:    "failures",
+			files:   map[string]string{"a.gse": "a", "bad.gse": "x"},
+			summary: "2 files: 1 done, 1 failed, 0 up to date",
+			err:     "1 of 2 files failed",
+			expect:  map[string]string{"a.gsc": "a"},
+		},
+		{
+			name:    "-outdir creates the mirrored directories",
+			flags:   []string{"-R"},
+			files:   map[string]string{"a.gse": "a", "sub/b.gse": "b"},
+			outdir:  true,
+			summary: "2 files: 2 done, 0 failed, 0 up to date",
+			expect:  map[string]string{"out/a.gsc": "a", "out/sub/b.gsc": "b"},
+		},
+	}
+
+	for _, c := range cases {
+		dir := t.TempDir()
+		writeFiles(t, dir, c.files)
+		for name := range c.files {
+			path := filepath.Join(dir, name)
+			// Inputs are older than the outputs named new, and newer than the others.
+			mtime := old
+			if c.files[name] == "new" {
+				mtime = time.Now()
+			} else if filepath.Ext(name) == ".gsc" {
+				mtime = old.Add(-time.Hour)
+			}
+			if err := os.Chtimes(path, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		flags := c.flags
+		if c.outdir {
+			flags = append(flags, "-outdir", filepath.Join(dir, "out"))
+		}
+		fs, b := parseBatchFlags(t, flags...)
+		jobs, err := b.jobs(fs, []string{dir}, []string{".gse"}, ".gsc")
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		stderr := captureStderr(t, func() {
+			err = b.run(jobs, copyProcess)
+		})
+
+		if !strings.Contains(stderr, c.summary) {
+			t.Fatalf("%v\nexpect: %v\ngot: %v", c.name, c.summary, stderr)
+		}
+		if c.err == "" && err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("%v\nexpect: %v\ngot: %v", c.name, c.err, err)
+			}
+			// Failures of many files exit with the general status, whatever the cause.
+			if code := exitCode(err); code != exitFailure {
+				t.Fatalf("%v\nexpect: exit status %v\ngot: %v", c.name, exitFailure, code)
+			}
+		}
+		for name, data := range c.expect {
+			if got := readFile(t, filepath.Join(dir, name)); got != data {
+				t.Fatalf("%v: %v\nexpect: %v\ngot: %v", c.name, name, data, got)
+			}
+		}
+	}
+}
+
+func TestBatchRunSingle(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"bad.gse": "x"})
+	fs, b := parseBatchFlags(t)
+	jobs, err := b.jobs(fs, []string{filepath.Join(dir, "bad.gse")}, []string{".gse"}, ".gsc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A single file reports its own error, which keeps its specific exit status.
+	stderr := captureStderr(t, func() {
+		err = b.run(jobs, copyProcess)
+	})
+	if !errors.Is(err, gshe.ErrWrongKey) || exitCode(err) != exitWrongKey {
+		t.Fatalf("\nexpect: %v\ngot: %v", gshe.ErrWrongKey, err)
+	}
+	if strings.Contains(stderr, "files:") {
+		t.Fatalf("summary printed for a single file: %v", stderr)
+	}
+}
+
+func TestBatchStdio(t *testing.T) {
+	dir := t.TempDir()
+	exists := filepath.Join(dir, "exists.gsc")
+	writeFiles(t, dir, map[string]string{"exists.gsc": "old", "a.gse": "a"})
+
+	// Standard input is written to standard output by default.
+	for _, c := range []struct {
+		flags  []string
+		args   []string
+		expect job
+		err    string
+	}{
+		{nil, []string{"-"}, job{stdio, stdio}, ""},
+		{[]string{"-o", exists}, []string{"-"}, job{stdio, exists}, ""},
+		{[]string{"-outdir", dir}, []string{"-"}, job{stdio, stdio}, ""},
+		{nil, []string{"-", filepath.Join(dir, "a.gse")}, job{}, "- must be the only input"},
+		{nil, []string{filepath.Join(dir, "a.gse"), "-"}, job{}, "- must be the only input"},
+	} {
+		fs, b := parseBatchFlags(t, c.flags...)
+		jobs, err := b.jobs(fs, c.args, []string{".gse"}, ".gsc")
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("%v\nexpect: %v\ngot: %v", c.args, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: %v", c.args, err)
+		}
+		if len(jobs) != 1 || jobs[0] != c.expect {
+			t.Fatalf("%v\nexpect: %v\ngot: %v", c.args, c.expect, jobs)
+		}
+	}
+
+	// The answer to overwriting cannot be read from standard input.
+	process := func(in, out string) error { return ioutil.WriteFile(out, []byte("new"), 0644) }
+	fs, b := parseBatchFlags(t, "-o", exists)
+	jobs, err := b.jobs(fs, []string{"-"}, []string{".gse"}, ".gsc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := exists + " already exists, use -f to overwrite"
+	if err := b.run(jobs, process); err == nil || err.Error() != expect {
+		t.Fatalf("\nexpect: %v\ngot: %v", expect, err)
+	}
+	if got := readFile(t, exists); got != "old" {
+		t.Fatalf("\nexpect: %v\ngot: %v", "old", got)
+	}
+
+	fs, b = parseBatchFlags(t, "-f", "-o", exists)
+	jobs, err = b.jobs(fs, []string{"-"}, []string{".gse"}, ".gsc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.run(jobs, process); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, exists); got != "new" {
+		t.Fatalf("\nexpect: %v\ngot: %v", "new", got)
+	}
+}
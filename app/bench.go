@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sinacam/gshe"
+	"github.com/Sinacam/gshe/internal/testimage"
+)
+
+// benchResult is the speed of one stage of the pipeline on one image.
+type benchResult struct {
+	Image string
+	Stage string
+	Bytes int // of the image
+	PerOp time.Duration
+}
+
+// Throughput in MB/s of the image.
+func (r benchResult) MBps() float64 {
+	return float64(r.Bytes) / r.PerOp.Seconds() / 1e6
+}
+
+// Measures the throughput of encryption, compression and decryption
+// on this machine, of synthetic images or the given one.
+func runBench(args []string) error {
+	fs := newFlagSet("bench", "[options] [input_file]")
+	sizes := fs.String("sizes", "256,1024,4096", "comma separated sides of the square synthetic images")
+	quantization := fs.Uint("q", 4, "quantization for compression, a power of 2")
+	lossless := fs.Bool("l", false, "encrypt and compress losslessly, ignoring the quantization")
+	minTime := fs.Duration("t", time.Second, "minimum time of measuring each stage")
+	fs.Parse(args)
+
+	if fs.NArg() > 1 {
+		return newUsageError(fs, "too many input files")
+	}
+	if *quantization > 255 {
+		return newUsageError(fs, "invalid quantization")
+	}
+	if *minTime <= 0 {
+		return newUsageError(fs, "invalid -t")
+	}
+
+	type namedImage struct {
+		name string
+		img  *gshe.Image
+	}
+	var imgs []namedImage
+	if fs.NArg() == 1 {
+		img, err := readImage(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		imgs = append(imgs, namedImage{fs.Arg(0), img})
+	} else {
+		for _, s := range strings.Split(*sizes, ",") {
+			size, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil || size < 2 || size > gshe.MaxDimension {
+				return newUsageError(fs, fmt.Sprintf("invalid size %q", s))
+			}
+			img, err := syntheticImage(size)
+			if err != nil {
+				return err
+			}
+			imgs = append(imgs, namedImage{fmt.Sprintf("%vx%v", size, size), img})
+		}
+	}
+
+	fmt.Printf("%-16v %-10v %10v %12v\n", "image", "stage", "MB/s", "ms/op")
+	for _, ni := range imgs {
+		results, err := benchPipeline(ni.name, ni.img, uint8(*quantization), *lossless, *minTime)
+		if err != nil {
+			return err
+		}
+		writeBench(os.Stdout, results)
+	}
+	return nil
+}
+
+// Measures every stage of the pipeline on img, each for at least minTime.
+func benchPipeline(name string, img *gshe.Image, quantization uint8, lossless bool, minTime time.Duration) ([]benchResult, error) {
+	key := []byte("bench key")
+	encOpts := &gshe.EncryptOptions{Lossless: lossless}
+
+	var enc *gshe.EncryptedImage
+	var comp *gshe.CompressedImage
+	stages := []struct {
+		name string
+		run  func() error
+	}{
+		{"encrypt", func() (err error) {
+			enc, err = encOpts.Encrypt(img, key)
+			return err
+		}},
+		{"compress", func() (err error) {
+			if lossless {
+				comp, err = gshe.CompressLossless(enc)
+			} else {
+				comp, err = gshe.Compress(enc, quantization)
+			}
+			return err
+		}},
+		{"decrypt", func() error {
+			_, err := gshe.Decrypt(comp, key)
+			return err
+		}},
+	}
+
+	results := make([]benchResult, 0, len(stages))
+	for _, s := range stages {
+		perOp, err := measure(s.run, minTime)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", s.name, err)
+		}
+		results = append(results, benchResult{name, s.name, len(img.Image), perOp})
+	}
+	return results, nil
+}
+
+// Returns the mean time of running f repeatedly for at least minTime.
+func measure(f func() error, minTime time.Duration) (time.Duration, error) {
+	start := time.Now()
+	for n := 1; ; n++ {
+		if err := f(); err != nil {
+			return 0, err
+		}
+		if elapsed := time.Since(start); elapsed >= minTime {
+			return elapsed / time.Duration(n), nil
+		}
+	}
+}
+
+func writeBench(w io.Writer, results []benchResult) {
+	for _, r := range results {
+		fmt.Fprintf(w, "%-16v %-10v %10.2f %12.3f\n", r.Image, r.Stage, r.MBps(), r.PerOp.Seconds()*1e3)
+	}
+}
+
+// Returns a size x size image with smooth regions, edges and noise.
+func syntheticImage(size int) (*gshe.Image, error) {
+	return gshe.NewImage(testimage.Synthetic(size), size, size)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBenchPipeline(t *testing.T) {
+	img, err := syntheticImage(64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, lossless := range []bool{false, true} {
+		results, err := benchPipeline("64x64", img, 4, lossless, time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 3 {
+			t.Fatalf("\nexpect: %v stages\ngot: %v", 3, results)
+		}
+		for _, r := range results {
+			if r.Bytes != 64*64 || r.PerOp <= 0 || r.MBps() <= 0 {
+				t.Fatalf("\nexpect: %v bytes and positive time\ngot: %+v", 64*64, r)
+			}
+		}
+	}
+}
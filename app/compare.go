@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/Sinacam/gshe"
+	"github.com/Sinacam/gshe/metrics"
+)
+
+// Prints the quality metrics between an original and a decoded image.
+func runCompare(args []string) error {
+	fs := newFlagSet("compare", "[options] original_file decoded_file")
+	asJSON := fs.Bool("json", false, "print the metrics as JSON")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		return newUsageError(fs, "two input files must be specified")
+	}
+
+	var imgs [2]*gshe.Image
+	for i, path := range fs.Args() {
+		img, err := readImage(path)
+		if err != nil {
+			return err
+		}
+		imgs[i] = img
+	}
+
+	m, err := metrics.Compute(imgs[0], imgs[1])
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(m)
+	}
+	fmt.Printf("MSE:     %.4f\n", m.MSE)
+	fmt.Printf("PSNR:    %.4f dB\n", m.PSNR)
+	fmt.Printf("SSIM:    %.6f\n", m.SSIM)
+	fmt.Printf("MS-SSIM: %.6f\n", m.MSSSIM)
+	return nil
+}
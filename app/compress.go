@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Sinacam/gshe"
+)
+
+func runCompress(args []string) error {
+	fs := newFlagSet("compress", "[options] input_file...")
+	batch := addBatchFlags(fs, ".gsc")
+	quantization := fs.Uint("q", 1, "quantization for compression, a power of 2")
+	lossless := fs.Bool("l", false, "lossless compression, the image must be encrypted losslessly")
+	fs.Parse(args)
+
+	jobs, err := batch.jobs(fs, fs.Args(), []string{".gse"}, ".gsc")
+	if err != nil {
+		return err
+	}
+	if *quantization > 255 {
+		return newUsageError(fs, "invalid quantization")
+	}
+
+	return batch.run(jobs, func(in, out string) error {
+		enc, err := readEncrypted(in)
+		if err != nil {
+			return err
+		}
+
+		var comp *gshe.CompressedImage
+		if *lossless {
+			comp, err = gshe.CompressLossless(enc)
+		} else {
+			comp, err = gshe.Compress(enc, uint8(*quantization))
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(jobs) == 1 {
+			originalSize := comp.Height * comp.Width
+			compressedSize := len(comp.Qtable) + len(comp.EncQdiffs) + len(comp.EncResiduals) + len(comp.Quarterimage)
+			ratio := float64(compressedSize) / float64(originalSize)
+			fmt.Fprintf(os.Stderr, "q: %v orig: %6dk diffs: %6dk comp: %6dk ratio: %.3f\n",
+				*quantization, originalSize/1000, len(comp.EncQdiffs)/1000, compressedSize/1000, ratio)
+		}
+		return writeBinary(out, comp)
+	})
+}
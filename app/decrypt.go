@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+
+	"github.com/Sinacam/gshe"
+)
+
+var interpolators = map[string]gshe.Interpolator{
+	"cai":      nil, // configured by -t
+	"bilinear": gshe.Bilinear{},
+	"bicubic":  gshe.Bicubic{},
+	"nedi":     gshe.EdgeDirected{},
+}
+
+var borders = map[string]gshe.Border{
+	"extrapolate": gshe.BorderExtrapolate,
+	"mirror":      gshe.BorderMirror,
+	"replicate":   gshe.BorderReplicate,
+	"cai3":        gshe.BorderCAI3,
+}
+
+func runDecrypt(args []string) error {
+	fs := newFlagSet("decrypt", "[options] input_file...")
+	batch := addBatchFlags(fs, ".png")
+	format := fs.String("format", "", "output format, one of png, pgm, tiff, bmp, default is by the output extension or png")
+	keys := addKeyFlags(fs)
+	threshold := fs.Int("t", 0, "interpolation threshold, 0 estimates it from the image")
+	interpolator := fs.String("i", "cai", "interpolator, one of cai, bilinear, bicubic, nedi")
+	iterations := fs.Int("n", 0, "iterations of refinement")
+	border := fs.String("b", "extrapolate", "border handling of cai, one of extrapolate, mirror, replicate, cai3")
+	region := fs.String("r", "", "decrypt only the region x0,y0,x1,y1")
+	fs.Parse(args)
+
+	outExt, err := outputExt(fs, *format)
+	if err != nil {
+		return err
+	}
+	jobs, err := batch.jobs(fs, fs.Args(), []string{".gsc"}, outExt)
+	if err != nil {
+		return err
+	}
+	key, err := keys.key(false)
+	if err != nil {
+		return err
+	}
+	defer zero(key)
+
+	opts := &gshe.DecryptOptions{
+		Threshold:  *threshold,
+		Iterations: *iterations,
+	}
+	var ok bool
+	if opts.Interpolator, ok = interpolators[*interpolator]; !ok {
+		return newUsageError(fs, "unknown interpolator")
+	}
+	if opts.Border, ok = borders[*border]; !ok {
+		return newUsageError(fs, "unknown border")
+	}
+
+	var r image.Rectangle
+	if *region != "" {
+		if _, err := fmt.Sscanf(*region, "%d,%d,%d,%d", &r.Min.X, &r.Min.Y, &r.Max.X, &r.Max.Y); err != nil {
+			return newUsageError(fs, "invalid region")
+		}
+	}
+
+	return batch.run(jobs, func(in, out string) error {
+		comp, err := readCompressed(in)
+		if err != nil {
+			return err
+		}
+
+		var dec *gshe.Image
+		if *region != "" {
+			dec, err = gshe.DecryptRegionWithOptions(comp, key, r, opts)
+		} else {
+			dec, err = gshe.DecryptWithOptions(comp, key, opts)
+		}
+		if err != nil {
+			return err
+		}
+		return writeImage(out, *format, dec)
+	})
+}
+
+// Returns the default output extension for format, see outputFormat.
+func outputExt(fs *flag.FlagSet, format string) (string, error) {
+	if format == "" {
+		return ".png", nil
+	}
+	format, err := outputFormat(format, "")
+	if err != nil {
+		return "", &usageError{fs, err}
+	}
+	return "." + format, nil
+}
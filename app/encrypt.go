@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Sinacam/gshe"
+)
+
+func runEncrypt(args []string) error {
+	fs := newFlagSet("encrypt", "[options] input_file...")
+	batch := addBatchFlags(fs, ".gse")
+	keys := addKeyFlags(fs)
+	lossless := fs.Bool("l", false, "lossless encryption")
+	fs.Parse(args)
+
+	jobs, err := batch.jobs(fs, fs.Args(), imageExts, ".gse")
+	if err != nil {
+		return err
+	}
+	key, err := keys.key(true)
+	if err != nil {
+		return err
+	}
+	defer zero(key)
+
+	opts := &gshe.EncryptOptions{Lossless: *lossless}
+	return batch.run(jobs, func(in, out string) error {
+		img, err := readImage(in)
+		if err != nil {
+			return err
+		}
+		if len(jobs) == 1 {
+			fmt.Fprintf(os.Stderr, "width: %v height: %v\n", img.Width, img.Height)
+		}
+
+		enc, err := gshe.EncryptWithOptions(img, key, opts)
+		if err != nil {
+			return err
+		}
+		return writeBinary(out, enc)
+	})
+}
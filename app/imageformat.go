@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sinacam/gshe"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// Extensions of the images that can be read.
+var imageExts = []string{".png", ".gif", ".jpg", ".jpeg", ".pgm", ".pnm", ".pbm", ".ppm", ".tif", ".tiff", ".bmp", ".webp"}
+
+// Encoders of the output image formats.
+var imageEncoders = map[string]func(io.Writer, *image.Gray) error{
+	"png": func(w io.Writer, img *image.Gray) error {
+		return png.Encode(w, img)
+	},
+	"pgm": encodePGM,
+	"tiff": func(w io.Writer, img *image.Gray) error {
+		return tiff.Encode(w, img, &tiff.Options{Compression: tiff.Deflate})
+	},
+	"bmp": func(w io.Writer, img *image.Gray) error {
+		return bmp.Encode(w, img)
+	},
+}
+
+// Output formats of extensions.
+var formatOfExt = map[string]string{
+	".png":  "png",
+	".pgm":  "pgm",
+	".pnm":  "pgm",
+	".tif":  "tiff",
+	".tiff": "tiff",
+	".bmp":  "bmp",
+}
+
+// Returns the output format named by format, or else by the extension of path.
+// Paths of unknown extension are written as png.
+func outputFormat(format, path string) (string, error) {
+	if format != "" {
+		format = strings.ToLower(format)
+		if _, ok := imageEncoders[format]; !ok {
+			return "", fmt.Errorf("unknown output format %v", format)
+		}
+		return format, nil
+	}
+	if f, ok := formatOfExt[strings.ToLower(filepath.Ext(path))]; ok {
+		return f, nil
+	}
+	return "png", nil
+}
+
+// Writes img to path in the output format named by format, see outputFormat.
+func writeImage(path, format string, img *gshe.Image) error {
+	format, err := outputFormat(format, path)
+	if err != nil {
+		return err
+	}
+	f, err := createOutput(path)
+	if err != nil {
+		return err
+	}
+	if err := imageEncoders[format](f, grayFromImage(img)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/Sinacam/gshe"
+)
+
+// inspection is what inspect prints about an encoded image.
+// Fields that do not apply to the kind of image are omitted.
+type inspection struct {
+	Kind          string         `json:"kind"`
+	Version       int            `json:"version"`
+	Width         int            `json:"width"`
+	Height        int            `json:"height"`
+	PadWidth      bool           `json:"pad_width"`
+	PadHeight     bool           `json:"pad_height"`
+	Salt          string         `json:"salt"`
+	Lossless      bool           `json:"lossless"`
+	Quantization  int            `json:"quantization,omitempty"`
+	Qtable        []int          `json:"qtable,omitempty"`
+	Histogram     []int          `json:"qdiffs_histogram,omitempty"`
+	Entropy       float64        `json:"qdiffs_entropy,omitempty"`
+	Sections      map[string]int `json:"sections"`
+	FileSize      int            `json:"file_size"`
+	BitsPerPixel  float64        `json:"bits_per_pixel"`
+	sectionsOrder []string
+}
+
+// Prints metadata and statistics of an encrypted or compressed image,
+// which does not need the key.
+func runInspect(args []string) error {
+	fs := newFlagSet("inspect", "[options] input_file")
+	asJSON := fs.Bool("json", false, "print as JSON")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return newUsageError(fs, "no input file specified")
+	}
+
+	data, err := readInput(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	ins, err := inspect(data)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(ins)
+	}
+	printInspection(ins)
+	return nil
+}
+
+func inspect(data []byte) (*inspection, error) {
+	kind, version := gshe.Sniff(data)
+	ins := &inspection{
+		Kind:     kind.String(),
+		Version:  version,
+		Sections: map[string]int{},
+		FileSize: len(data),
+	}
+	section := func(name string, size int) {
+		ins.Sections[name] = size
+		ins.sectionsOrder = append(ins.sectionsOrder, name)
+	}
+
+	switch kind {
+	case gshe.KindEncrypted:
+		enc := &gshe.EncryptedImage{}
+		if err := enc.UnmarshalBinary(data); err != nil {
+			return nil, err
+		}
+		ins.Width, ins.Height = enc.Width, enc.Height
+		ins.PadWidth, ins.PadHeight = enc.PadWidth, enc.PadHeight
+		ins.Salt = hex.EncodeToString(enc.Salt)
+		ins.Lossless = len(enc.Antidiagonal) > 0
+		section("halfimage", len(enc.Halfimage))
+		section("antidiagonal", len(enc.Antidiagonal))
+		section("salt", len(enc.Salt))
+
+	case gshe.KindCompressed:
+		comp := &gshe.CompressedImage{}
+		if err := comp.UnmarshalBinary(data); err != nil {
+			return nil, err
+		}
+		ins.Width, ins.Height = comp.Width, comp.Height
+		ins.PadWidth, ins.PadHeight = comp.PadWidth, comp.PadHeight
+		ins.Salt = hex.EncodeToString(comp.Salt)
+		ins.Lossless = len(comp.EncResiduals) > 0
+		if len(comp.Qtable) > 0 {
+			ins.Quantization = 256 / len(comp.Qtable)
+		}
+		ins.Qtable = make([]int, len(comp.Qtable))
+		for i, v := range comp.Qtable {
+			ins.Qtable[i] = int(v)
+		}
+
+		qdiffs, err := comp.DecodeQdiffs()
+		if err != nil {
+			return nil, err
+		}
+		ins.Histogram = make([]int, len(comp.Qtable))
+		for _, v := range qdiffs {
+			if int(v) >= len(ins.Histogram) {
+				return nil, errors.New("qdiff out of range of qtable")
+			}
+			ins.Histogram[v]++
+		}
+		ins.Entropy = entropy(ins.Histogram, len(qdiffs))
+
+		section("quarterimage", len(comp.Quarterimage))
+		section("qtable", len(comp.Qtable))
+		section("qdiffs", len(comp.EncQdiffs))
+		section("residuals", len(comp.EncResiduals))
+		section("salt", len(comp.Salt))
+
+	default:
+		return nil, errors.New("not an encrypted or compressed image")
+	}
+
+	pixels := ins.Width * ins.Height
+	if ins.PadWidth {
+		pixels -= ins.Height
+	}
+	if ins.PadHeight {
+		pixels -= ins.Width
+	}
+	if ins.PadWidth && ins.PadHeight {
+		pixels++
+	}
+	if pixels > 0 {
+		ins.BitsPerPixel = float64(8*ins.FileSize) / float64(pixels)
+	}
+	return ins, nil
+}
+
+// Returns the entropy in bits per symbol of the histogram of n symbols.
+func entropy(histogram []int, n int) float64 {
+	h := 0.0
+	for _, c := range histogram {
+		if c > 0 {
+			p := float64(c) / float64(n)
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
+
+func printInspection(ins *inspection) {
+	fmt.Printf("kind:           %v\n", ins.Kind)
+	fmt.Printf("version:        %v\n", ins.Version)
+	fmt.Printf("dimensions:     %vx%v\n", ins.Width, ins.Height)
+	fmt.Printf("padding:        width %v height %v\n", ins.PadWidth, ins.PadHeight)
+	fmt.Printf("salt:           %v\n", ins.Salt)
+	fmt.Printf("lossless:       %v\n", ins.Lossless)
+	if ins.Kind == gshe.KindCompressed.String() {
+		fmt.Printf("quantization:   %v\n", ins.Quantization)
+		fmt.Printf("qtable:         %v\n", formatInts(ins.Qtable))
+		fmt.Printf("qdiffs entropy: %.4f bits\n", ins.Entropy)
+		fmt.Printf("qdiffs histogram:\n")
+		for i, c := range ins.Histogram {
+			if c > 0 {
+				fmt.Printf("  %3d: %v\n", i, c)
+			}
+		}
+	}
+	fmt.Printf("sections:\n")
+	for _, name := range ins.sectionsOrder {
+		fmt.Printf("  %-13v %v bytes\n", name+":", ins.Sections[name])
+	}
+	fmt.Printf("file size:      %v bytes\n", ins.FileSize)
+	fmt.Printf("bits per pixel: %.4f\n", ins.BitsPerPixel)
+}
+
+func formatInts(v []int) string {
+	s := make([]string, len(v))
+	for i := range v {
+		s[i] = fmt.Sprint(v[i])
+	}
+	return strings.Join(s, " ")
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"testing"
+
+	"github.com/Sinacam/gshe"
+)
+
+func TestEntropy(t *testing.T) {
+	uniform := make([]int, 256)
+	for i := range uniform {
+		uniform[i] = 3
+	}
+	for _, c := range []struct {
+		name      string
+		histogram []int
+		expect    float64
+	}{
+		{"uniform", uniform, 8},
+		{"constant", []int{0, 12, 0, 0}, 0},
+		{"two halves", []int{5, 0, 5}, 1},
+		{"quarters", []int{1, 1, 2}, 1.5},
+	} {
+		n := 0
+		for _, v := range c.histogram {
+			n += v
+		}
+		if h := entropy(c.histogram, n); math.Abs(h-c.expect) > 1e-12 {
+			t.Fatalf("%v\nexpect: %v\ngot: %v", c.name, c.expect, h)
+		}
+	}
+}
+
+func TestInspect(t *testing.T) {
+	key := []byte("inspect key")
+	// 15x9 is padded to 16x10, but only its 135 pixels count for the bits per pixel.
+	const width, height, pixels = 15, 9, 135
+	data := make([]byte, width*height)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	img, err := gshe.NewImage(data, width, height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := gshe.Encrypt(img, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp, err := gshe.Compress(enc, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lossless, err := gshe.EncryptLossless(img, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	losslessComp, err := gshe.CompressLossless(lossless)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Written by the app of the first version.
+	legacy, err := ioutil.ReadFile("../testdata/golden/v0/q1/encrypted.gse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The qdiffs of the compression are the differences of the pairs
+	// of the encrypted halfimage, quantized by 4.
+	histogram := make([]int, 64)
+	for i := 0; i < len(enc.Halfimage); i += 2 {
+		histogram[(enc.Halfimage[i+1]-enc.Halfimage[i])>>2]++
+	}
+
+	marshal := func(img interface{ MarshalBinary() ([]byte, error) }) []byte {
+		data, err := img.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	for _, c := range []struct {
+		name         string
+		data         []byte
+		kind         gshe.Kind
+		version      int
+		width        int
+		height       int
+		pixels       int
+		lossless     bool
+		quantization int
+		histogram    []int
+		sections     map[string]int
+	}{
+		{
+			name: "encrypted", data: marshal(enc), kind: gshe.KindEncrypted, version: gshe.FormatVersion,
+			width: 16, height: 10, pixels: pixels,
+			sections: map[string]int{"halfimage": 80, "antidiagonal": 0, "salt": 16},
+		},
+		{
+			name: "lossless encrypted", data: marshal(lossless), kind: gshe.KindEncrypted, version: gshe.FormatVersion,
+			width: 16, height: 10, pixels: pixels, lossless: true,
+			sections: map[string]int{"halfimage": 80, "antidiagonal": 80, "salt": 16},
+		},
+		{
+			name: "compressed", data: marshal(comp), kind: gshe.KindCompressed, version: gshe.FormatVersion,
+			width: 16, height: 10, pixels: pixels, quantization: 4, histogram: histogram,
+			sections: map[string]int{"quarterimage": 40, "qtable": 64, "qdiffs": len(comp.EncQdiffs), "residuals": 0, "salt": 16},
+		},
+		{
+			name: "lossless compressed", data: marshal(losslessComp), kind: gshe.KindCompressed, version: gshe.FormatVersion,
+			width: 16, height: 10, pixels: pixels, lossless: true, quantization: 1,
+			sections: map[string]int{"quarterimage": 40, "qtable": 256, "qdiffs": len(losslessComp.EncQdiffs),
+				"residuals": len(losslessComp.EncResiduals), "salt": 16},
+		},
+		{
+			name: "version 0", data: legacy, kind: gshe.KindEncrypted, version: 0,
+			width: 16, height: 12, pixels: 16 * 12,
+			sections: map[string]int{"halfimage": 96, "antidiagonal": 0, "salt": 16},
+		},
+	} {
+		ins, err := inspect(c.data)
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		if ins.Kind != c.kind.String() || ins.Version != c.version || ins.Width != c.width || ins.Height != c.height ||
+			ins.Lossless != c.lossless || ins.Quantization != c.quantization || ins.FileSize != len(c.data) {
+			t.Fatalf("%v\nexpect: %+v\ngot: %+v", c.name, c, ins)
+		}
+		if bpp := float64(8*len(c.data)) / float64(c.pixels); ins.BitsPerPixel != bpp {
+			t.Fatalf("%v: bits per pixel\nexpect: %v\ngot: %v", c.name, bpp, ins.BitsPerPixel)
+		}
+		if len(ins.Sections) != len(c.sections) {
+			t.Fatalf("%v: sections\nexpect: %v\ngot: %v", c.name, c.sections, ins.Sections)
+		}
+		for name, size := range c.sections {
+			if got, ok := ins.Sections[name]; !ok || got != size {
+				t.Fatalf("%v: sections\nexpect: %v\ngot: %v", c.name, c.sections, ins.Sections)
+			}
+		}
+		if c.histogram != nil {
+			n := 0
+			for i, v := range c.histogram {
+				n += v
+				if ins.Histogram[i] != v {
+					t.Fatalf("%v: histogram\nexpect: %v\ngot: %v", c.name, c.histogram, ins.Histogram)
+				}
+			}
+			if h := entropy(c.histogram, n); ins.Entropy != h {
+				t.Fatalf("%v: entropy\nexpect: %v\ngot: %v", c.name, h, ins.Entropy)
+			}
+		}
+	}
+
+	if _, err := inspect([]byte("P5\n1 1\n255\n\x00")); err == nil {
+		t.Fatal("inspected an image that is not encrypted or compressed")
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// passkeyEnv is the environment variable of the passkey,
+// used when no key is given by the flags.
+// Like -p, it is a Go string, whose copies cannot be zeroed.
+const passkeyEnv = "GSHE_PASSKEY"
+
+// maxPasskey is the longest passkey read from -key-fd.
+const maxPasskey = 1024
+
+// ttyPath is the terminal the passkey is asked for on. Standard input
+// is not used, as it may be the input image.
+var ttyPath = "/dev/tty"
+
+// keyFlags are the flags of commands that need a key.
+type keyFlags struct {
+	fs               *flag.FlagSet
+	passkey, keyPath *string
+	keyFd            *int
+}
+
+func addKeyFlags(fs *flag.FlagSet) *keyFlags {
+	return &keyFlags{
+		fs:      fs,
+		keyPath: fs.String("k", "", "path to key file"),
+		passkey: fs.String("p", "", "passkey, visible to other users in the process list and, like $"+passkeyEnv+", never zeroed in memory"),
+		keyFd:   fs.Int("key-fd", -1, "file descriptor to read the passkey from"),
+	}
+}
+
+// Returns the key given by the flags, or else by passkeyEnv,
+// or else asks for it on the terminal.
+// When asking, the passkey is asked twice if confirm is set.
+// The caller should zero the key after use.
+func (k *keyFlags) key(confirm bool) ([]byte, error) {
+	given := 0
+	for _, set := range []bool{*k.passkey != "", *k.keyPath != "", *k.keyFd >= 0} {
+		if set {
+			given++
+		}
+	}
+	if given > 1 {
+		return nil, newUsageError(k.fs, "two passkeys provided")
+	}
+
+	switch {
+	case *k.passkey != "":
+		return []byte(*k.passkey), nil
+	case *k.keyPath != "":
+		key, err := readKey(*k.keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key file: %v", err)
+		}
+		return key, nil
+	case *k.keyFd >= 0:
+		return readKeyFd(*k.keyFd)
+	}
+
+	if key, ok := os.LookupEnv(passkeyEnv); ok && key != "" {
+		return []byte(key), nil
+	}
+	tty, err := os.OpenFile(ttyPath, os.O_RDWR, 0)
+	if err != nil {
+		return nil, newUsageError(k.fs, "no passkeys provided and no terminal to ask for one")
+	}
+	defer tty.Close()
+	if !term.IsTerminal(int(tty.Fd())) {
+		return nil, newUsageError(k.fs, "no passkeys provided and no terminal to ask for one")
+	}
+	return promptKey(tty, confirm)
+}
+
+// Asks for the passkey on the terminal tty without echo.
+func promptKey(tty *os.File, confirm bool) ([]byte, error) {
+	fd := int(tty.Fd())
+	fmt.Fprint(tty, "Passkey: ")
+	key, err := term.ReadPassword(fd)
+	fmt.Fprintln(tty)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		return nil, errors.New("empty passkey")
+	}
+
+	if confirm {
+		fmt.Fprint(tty, "Confirm passkey: ")
+		again, err := term.ReadPassword(fd)
+		fmt.Fprintln(tty)
+		defer zero(again)
+		if err != nil {
+			zero(key)
+			return nil, err
+		}
+		if !bytes.Equal(key, again) {
+			zero(key)
+			return nil, errors.New("passkeys do not match")
+		}
+	}
+	return key, nil
+}
+
+// Reads the passkey from the file descriptor fd until EOF,
+// without a trailing newline.
+// It is read into a buffer of fixed size, so that no copies are left behind.
+func readKeyFd(fd int) ([]byte, error) {
+	f := os.NewFile(uintptr(fd), "key-fd")
+	if f == nil {
+		return nil, fmt.Errorf("invalid key file descriptor %v", fd)
+	}
+	defer f.Close()
+
+	// Filling the room for the longest passkey, a CRLF and one more byte
+	// tells a passkey too long without reading it all.
+	buf := make([]byte, maxPasskey+len("\r\n")+1)
+	n, err := io.ReadFull(f, buf)
+	switch {
+	case err == nil:
+		zero(buf)
+		return nil, fmt.Errorf("passkey longer than %v bytes", maxPasskey)
+	case err != io.EOF && err != io.ErrUnexpectedEOF:
+		zero(buf)
+		return nil, err
+	}
+	key := bytes.TrimSuffix(buf[:n], []byte("\n"))
+	key = bytes.TrimSuffix(key, []byte("\r"))
+	if len(key) == 0 {
+		zero(buf)
+		return nil, errors.New("empty passkey")
+	}
+	if len(key) > maxPasskey {
+		zero(buf)
+		return nil, fmt.Errorf("passkey longer than %v bytes", maxPasskey)
+	}
+	zero(buf[len(key):])
+	return key, nil
+}
+
+func readKey(path string) ([]byte, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	dec := base64.NewDecoder(base64.StdEncoding, src)
+	return ioutil.ReadAll(dec)
+}
+
+// Overwrites the key so it does not linger in memory.
+func zero(key []byte) {
+	for i := range key {
+		key[i] = 0
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Returns the key of the key flags parsed from args.
+func keyOf(t *testing.T, args ...string) ([]byte, error) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	k := addKeyFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return k.key(false)
+}
+
+// The read ends of the pipes of keyFdFlag.
+var keyPipes []*os.File
+
+// Returns the flag reading data from a pipe.
+func keyFdFlag(t *testing.T, data string) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	keyPipes = append(keyPipes, r)
+	return "-key-fd=" + strconv.Itoa(int(r.Fd()))
+}
+
+func TestKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key")
+	// Without a terminal there is no prompt.
+	defer func(path string) { ttyPath = path }(ttyPath)
+	ttyPath = filepath.Join(t.TempDir(), "tty")
+	longest := strings.Repeat("k", maxPasskey)
+	if err := ioutil.WriteFile(path, []byte(base64.StdEncoding.EncodeToString([]byte("file key"))), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name   string
+		args   func() []string
+		env    string
+		expect string
+		err    string
+	}{
+		{"-p", func() []string { return []string{"-p", "flag key"} }, "", "flag key", ""},
+		{"-p over env", func() []string { return []string{"-p", "flag key"} }, "env key", "flag key", ""},
+		{"-k over env", func() []string { return []string{"-k", path} }, "env key", "file key", ""},
+		{"-key-fd over env", func() []string { return []string{keyFdFlag(t, "fd key")} }, "env key", "fd key", ""},
+		{"-key-fd newline", func() []string { return []string{keyFdFlag(t, "fd key\n")} }, "", "fd key", ""},
+		{"-key-fd crlf", func() []string { return []string{keyFdFlag(t, "fd key\r\n")} }, "", "fd key", ""},
+		{"-key-fd one newline", func() []string { return []string{keyFdFlag(t, "fd key\n\n")} }, "", "fd key\n", ""},
+		{"-key-fd empty", func() []string { return []string{keyFdFlag(t, "\n")} }, "", "", "empty passkey"},
+		{"-key-fd longest", func() []string { return []string{keyFdFlag(t, longest+"\r\n")} }, "", longest, ""},
+		{"-key-fd too long", func() []string { return []string{keyFdFlag(t, longest+"k")} }, "", "", "passkey longer than"},
+		{"-key-fd much too long", func() []string { return []string{keyFdFlag(t, longest+longest)} }, "", "", "passkey longer than"},
+		{"env", func() []string { return nil }, "env key", "env key", ""},
+		{"none", func() []string { return nil }, "", "", "no terminal"},
+		{"-p and -k", func() []string { return []string{"-p", "flag key", "-k", path} }, "", "", "two passkeys provided"},
+		{"-p and -key-fd", func() []string { return []string{"-p", "flag key", "-key-fd", "0"} }, "", "", "two passkeys provided"},
+		{"-k and -key-fd", func() []string { return []string{"-k", path, "-key-fd", "0"} }, "", "", "two passkeys provided"},
+		{"missing -k", func() []string { return []string{"-k", path + ".missing"} }, "", "", "invalid key file"},
+	} {
+		t.Setenv(passkeyEnv, c.env)
+		key, err := keyOf(t, c.args()...)
+		// readKeyFd closed the descriptors, closing the files too before they
+		// can be reused keeps their finalizers from closing them again.
+		for _, r := range keyPipes {
+			r.Close()
+		}
+		keyPipes = nil
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("%v\nexpect: %v\ngot: %v", c.name, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		if string(key) != c.expect {
+			t.Fatalf("%v\nexpect: %q\ngot: %q", c.name, c.expect, key)
+		}
+	}
+
+	// Without a terminal a missing key is an error in the arguments.
+	t.Setenv(passkeyEnv, "")
+	var uerr *usageError
+	if _, err := keyOf(t); !errors.As(err, &uerr) {
+		t.Fatalf("\nexpect: usage error\ngot: %v", err)
+	}
+}
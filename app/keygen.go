@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+)
+
+// Generates a key file of random bytes.
+func runKeygen(args []string) error {
+	fs := newFlagSet("keygen", "[options] key_file")
+	size := fs.Int("n", 32, "number of random bytes in the key")
+	overwrite := fs.Bool("f", false, "force overwrite existing files")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return newUsageError(fs, "no key file specified")
+	}
+	if *size <= 0 {
+		return newUsageError(fs, "invalid key size")
+	}
+	outPath := fs.Arg(0)
+	if err := checkOverwrite(outPath, *overwrite); err != nil {
+		return err
+	}
+
+	key := make([]byte, *size)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+
+	f, err := createOutput(outPath)
+	if err != nil {
+		return err
+	}
+	enc := base64.NewEncoder(base64.StdEncoding, f)
+	if _, err := enc.Write(key); err != nil {
+		f.Close()
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write([]byte("\n")); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Sinacam/gshe"
+)
+
+// Runs the legacy form of the app, where the mode is selected by -e, -c, -d
+// or inferred from the extension of the input file.
+// The flags are passed on to the command of the mode.
+func runLegacy(args []string) error {
+	fs := flag.NewFlagSet("", flag.ExitOnError)
+	fs.String("o", "", "path to output file")
+	fs.String("k", "", "path to key file")
+	fs.String("p", "", "passkey")
+	fs.Uint("q", 1, "quantization for compression")
+	fs.Int("t", 0, "interpolation threshold for decryption, 0 estimates it from the image")
+	fs.String("i", "cai", "interpolator for decryption, one of cai, bilinear, bicubic, nedi")
+	fs.Int("n", 0, "iterations of refinement for decryption")
+	fs.String("b", "extrapolate", "border handling of cai, one of extrapolate, mirror, replicate, cai3")
+	fs.String("r", "", "decrypt only the region x0,y0,x1,y1")
+	encrypt := fs.Bool("e", false, "encrypt mode")
+	compress := fs.Bool("c", false, "compress mode")
+	decrypt := fs.Bool("d", false, "decrypt mode")
+	fs.Bool("f", false, "force overwrite existing files")
+	fs.Bool("l", false, "lossless encryption or compression")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [options] input_file\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return newUsageError(fs, "no input file specified")
+	}
+
+	mode := ""
+	modes := 0
+	if *encrypt {
+		modes++
+		mode = "encrypt"
+	}
+	if *decrypt {
+		modes++
+		mode = "decrypt"
+	}
+	if *compress {
+		modes++
+		mode = "compress"
+	}
+	if modes > 1 {
+		return newUsageError(fs, "multiple modes specified")
+	}
+
+	// infer mode if none is set
+	if mode == "" && fs.Arg(0) == stdio {
+		data, err := readInput(stdio)
+		if err != nil {
+			return err
+		}
+		mode = sniffMode(data)
+	}
+	if mode == "" {
+		switch ext := filepath.Ext(fs.Arg(0)); {
+		case ext == ".gse":
+			mode = "compress"
+		case ext == ".gsc":
+			mode = "decrypt"
+		case hasExt(ext, imageExts):
+			mode = "encrypt"
+		default:
+			return newUsageError(fs, "unknown file type")
+		}
+	}
+
+	// Only the flags used by the mode are passed on, the others were ignored.
+	var cmdArgs []string
+	fs.Visit(func(f *flag.Flag) {
+		if legacyFlags[mode][f.Name] {
+			cmdArgs = append(cmdArgs, fmt.Sprintf("-%v=%v", f.Name, f.Value))
+		}
+	})
+	cmdArgs = append(cmdArgs, "--", fs.Arg(0))
+
+	for _, c := range commands {
+		if c.name == mode {
+			return c.run(cmdArgs)
+		}
+	}
+	panic("unreachable")
+}
+
+// Returns the mode for the input data by its magic bytes,
+// anything that is not an encrypted or compressed image is assumed to be an image.
+func sniffMode(data []byte) string {
+	switch kind, _ := gshe.Sniff(data); kind {
+	case gshe.KindEncrypted:
+		return "compress"
+	case gshe.KindCompressed:
+		return "decrypt"
+	}
+	return "encrypt"
+}
+
+func nameSet(names ...string) map[string]bool {
+	m := map[string]bool{}
+	for _, name := range names {
+		m[name] = true
+	}
+	return m
+}
+
+var legacyFlags = map[string]map[string]bool{
+	"encrypt":  nameSet("o", "k", "p", "f", "l"),
+	"compress": nameSet("o", "q", "f", "l"),
+	"decrypt":  nameSet("o", "k", "p", "f", "t", "i", "n", "b", "r"),
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"testing"
+
+	"github.com/Sinacam/gshe"
+)
+
+// Returns a compressed image of version 0, a bare gob stream of
+// CompressedImage as the first version of gshe declared it.
+func legacyCompressed(t *testing.T) []byte {
+	type CompressedImage struct {
+		Quarterimage        []byte
+		Qtable              []byte
+		EncQdiffs           []byte
+		Salt                []byte
+		Width, Height       int
+		PadWidth, PadHeight bool
+	}
+	var buf bytes.Buffer
+	comp := &CompressedImage{make([]byte, 4), []byte{0}, make([]byte, 4), make([]byte, 16), 4, 4, false, false}
+	if err := gob.NewEncoder(&buf).Encode(comp); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSniffMode(t *testing.T) {
+	img, err := gshe.NewImage(make([]byte, 16*16), 16, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := gshe.Encrypt(img, []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp, err := gshe.Compress(enc, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Written by the app of the first version.
+	legacyEncrypted, err := ioutil.ReadFile("../testdata/golden/v0/q1/encrypted.gse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encData, err := enc.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	compData, err := comp.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name string
+		data []byte
+		mode string
+	}{
+		{"v1 encrypted", encData, "compress"},
+		{"v1 compressed", compData, "decrypt"},
+		{"v0 encrypted", legacyEncrypted, "compress"},
+		{"v0 compressed", legacyCompressed(t), "decrypt"},
+		{"magic only", []byte("\x89GSC"), "encrypt"},
+		{"pgm", []byte("P5\n2 2\n255\n\x00\x00\x00\x00"), "encrypt"},
+		{"empty", nil, "encrypt"},
+	} {
+		if mode := sniffMode(c.data); mode != c.mode {
+			t.Fatalf("%v\nexpect: %v\ngot: %v", c.name, c.mode, mode)
+		}
+	}
+}
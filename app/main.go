@@ -1,274 +1,254 @@
 package main
 
 import (
-	"encoding/base64"
-	"encoding/gob"
+	"bytes"
+	"encoding"
+	"errors"
 	"flag"
 	"fmt"
 	"image"
 	"image/draw"
-	_ "image/gif"
-	_ "image/jpeg"
-	"image/png"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/Sinacam/gshe"
 )
 
-var config struct {
-	// flag vars
-	keyPath                    string
-	inPath, outPath            string
-	encrypt, compress, decrypt bool
-	overwrite                  bool
-	quantization               uint
-	key                        string
+// command is a subcommand of the app.
+type command struct {
+	name string
+	help string // one line description
+	run  func(args []string) error
+}
 
-	mode int // stores the boolean mode flags as integer
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"encrypt", "encrypt an image", runEncrypt},
+		{"compress", "compress an encrypted image", runCompress},
+		{"decrypt", "decrypt a compressed image", runDecrypt},
+		{"preview", "decrypt a half resolution preview of a compressed image", runPreview},
+		{"inspect", "print metadata and statistics of an encrypted or compressed image", runInspect},
+		{"keygen", "generate a random key file", runKeygen},
+		{"compare", "print quality metrics between two images", runCompare},
+		{"rdcurve", "tabulate size and quality at every quantization", runRDCurve},
+		{"serve", "serve compression of encrypted images over HTTP", runServe},
+		{"bench", "measure the throughput of every stage on this machine", runBench},
+	}
 }
 
+// Exit codes of the app.
 const (
-	modeEncrypt = iota + 1
-	modeCompress
-	modeDecrypt
+	exitOK                 = 0
+	exitFailure            = 1
+	exitUsage              = 2
+	exitWrongKey           = 3
+	exitCorrupt            = 4
+	exitUnsupportedVersion = 5
+	exitInvalidDimensions  = 6
+	exitQuantization       = 7
 )
 
-func main() {
-	flag.StringVar(&config.outPath, "o", "", "path to output file")
-	flag.StringVar(&config.keyPath, "k", "", "path to key file")
-	flag.StringVar(&config.key, "p", "", "passkey")
-	flag.UintVar(&config.quantization, "q", 1, "quantization for compression")
-	flag.BoolVar(&config.encrypt, "e", false, "encrypt mode")
-	flag.BoolVar(&config.compress, "c", false, "compress mode")
-	flag.BoolVar(&config.decrypt, "d", false, "decrypt mode")
-	flag.BoolVar(&config.overwrite, "f", false, "force overwrite existing files")
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "usage: %s [options] input_file\n", os.Args[0])
-		flag.PrintDefaults()
+// Returns the exit code of a failure with err.
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, gshe.ErrWrongKey):
+		return exitWrongKey
+	case errors.Is(err, &gshe.ErrCorruptPayload{}):
+		return exitCorrupt
+	case errors.Is(err, gshe.ErrUnsupportedVersion):
+		return exitUnsupportedVersion
+	case errors.Is(err, gshe.ErrInvalidDimensions):
+		return exitInvalidDimensions
+	case errors.Is(err, gshe.ErrQuantization):
+		return exitQuantization
 	}
-	flag.Parse()
+	return exitFailure
+}
 
-	if len(flag.Args()) != 1 {
-		fmt.Fprintln(os.Stderr, "no input file specified")
-		flag.Usage()
-		return
-	}
+// usageError is an error in the arguments of a command,
+// which is reported along with the usage of the command.
+type usageError struct {
+	fs  *flag.FlagSet
+	err error
+}
 
-	config.inPath = flag.Arg(0)
-	name := filepath.Base(config.inPath)
-	ext := filepath.Ext(name)
+func (e *usageError) Error() string {
+	return e.err.Error()
+}
 
-	modes := 0
-	if config.encrypt {
-		modes++
-		config.mode = modeEncrypt
-	}
-	if config.decrypt {
-		modes++
-		config.mode = modeDecrypt
-	}
-	if config.compress {
-		modes++
-		config.mode = modeCompress
-	}
-	if modes > 1 {
-		fmt.Fprintln(os.Stderr, "multiple modes specified")
-		flag.Usage()
-		return
-	}
+func newUsageError(fs *flag.FlagSet, msg string) error {
+	return &usageError{fs, errors.New(msg)}
+}
 
-	// infer mode if none is set
-	if config.mode == 0 {
-		switch ext {
-		case ".gse":
-			config.mode = modeCompress
-		case ".gsc":
-			config.mode = modeDecrypt
-		case ".png":
-			fallthrough
-		case ".gif":
-			fallthrough
-		case ".jpg":
-			fallthrough
-		case ".jpeg":
-			config.mode = modeEncrypt
-		default:
-			fmt.Fprintln(os.Stderr, "unknown file type")
-			flag.Usage()
-			return
-		}
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// Runs the app with args and returns the exit code.
+func run(args []string) int {
+	if len(args) == 0 {
+		usage()
+		return exitUsage
 	}
 
-	// default output is same path with extension changed
-	if config.outPath == "" {
-		name = name[:len(name)-len(ext)]
-		outext := ""
-		switch config.mode {
-		case modeEncrypt:
-			outext = "gse"
-		case modeCompress:
-			outext = "gsc"
-		case modeDecrypt:
-			outext = "png"
+	var cmd *command
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		usage()
+		return exitOK
+	}
+	for _, c := range commands {
+		if c.name == args[0] {
+			cmd = c
+			args = args[1:]
+			break
 		}
-		config.outPath = filepath.Join(filepath.Dir(config.inPath), fmt.Sprintf("%v.%v", name, outext))
 	}
 
-	if config.mode == modeEncrypt || config.mode == modeDecrypt {
-		if config.key != "" && config.keyPath != "" {
-			fmt.Fprintln(os.Stderr, "two passkeys provided")
-			flag.Usage()
-			return
-		}
-		if config.key == "" && config.keyPath == "" {
-			fmt.Fprintln(os.Stderr, "no passkeys provided")
-			flag.Usage()
-			return
-		}
+	var err error
+	if cmd != nil {
+		err = cmd.run(args)
+	} else {
+		err = runLegacy(args)
+	}
 
-		if config.keyPath != "" {
-			key, err := readKey(config.keyPath)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, "invalid key file: ", err)
-				flag.Usage()
-				return
-			}
-			config.key = string(key)
-		}
+	var uerr *usageError
+	switch {
+	case errors.As(err, &uerr):
+		fmt.Fprintln(os.Stderr, err)
+		uerr.fs.Usage()
+		return exitUsage
+	case err != nil:
+		fmt.Fprintln(os.Stderr, err)
+		return exitCode(err)
 	}
+	return exitOK
+}
 
-	if config.quantization > 255 {
-		fmt.Fprintln(os.Stderr, "invalid quantization")
-		flag.Usage()
-		return
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s command [options] [arguments]\n\ncommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10v%v\n", c.name, c.help)
 	}
+	fmt.Fprintf(os.Stderr, "\nrun %s command -h for the options of a command\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "the legacy form %s [-e|-c|-d] [options] input_file is still accepted\n", os.Args[0])
+}
 
-	if !config.overwrite {
-		if _, err := os.Stat(config.outPath); err == nil {
-			fmt.Printf("Overwrite existing file %v? (y/[n]): ", config.outPath)
-			s := ""
-			fmt.Scanln(&s)
-			s = strings.ToLower(s)
-			switch s {
-			case "y":
-			case "yes":
-			default:
-				return
-			}
-		}
+// Returns a flag set whose usage is that of the command.
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s %s %s\n", os.Args[0], name, args)
+		fs.PrintDefaults()
 	}
+	return fs
+}
 
-	switch config.mode {
-	case modeEncrypt:
-		src, err := readGray(config.inPath)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			return
-		}
-		img, err := imageFromGray(src)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			return
-		}
-		fmt.Printf("width: %v height: %v\n", img.Width, img.Height)
+// Returns path with its extension replaced by ext, which is the default output.
+func defaultOutput(path, ext string) string {
+	name := filepath.Base(path)
+	name = name[:len(name)-len(filepath.Ext(name))]
+	return filepath.Join(filepath.Dir(path), name+ext)
+}
 
-		enc, err := gshe.Encrypt(img, []byte(config.key))
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			return
-		}
+// stdio is the path of standard input or output.
+const stdio = "-"
 
-		outfile, err := os.OpenFile(config.outPath, os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			return
-		}
-		defer outfile.Close()
-		if err := gob.NewEncoder(outfile).Encode(enc); err != nil {
-			fmt.Println(err)
-			return
-		}
+var stdin struct {
+	once sync.Once
+	data []byte
+	err  error
+}
 
-	case modeCompress:
-		enc := &gshe.EncryptedImage{}
-		infile, err := os.Open(config.inPath)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			return
-		}
-		defer infile.Close()
-		if err := gob.NewDecoder(infile).Decode(enc); err != nil {
-			fmt.Println(err)
-			return
-		}
+// Reads the file at path, or standard input if path is stdio.
+// Standard input is read only once, later reads return the same data.
+func readInput(path string) ([]byte, error) {
+	if path != stdio {
+		return ioutil.ReadFile(path)
+	}
+	stdin.once.Do(func() {
+		stdin.data, stdin.err = ioutil.ReadAll(os.Stdin)
+	})
+	return stdin.data, stdin.err
+}
 
-		comp, err := gshe.Compress(enc, uint8(config.quantization))
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+// Returns an error if path exists and should not be overwritten.
+func checkOverwrite(path string, force bool) error {
+	if !force && !confirmOverwrite(path) {
+		return fmt.Errorf("not overwriting %v", path)
+	}
+	return nil
+}
 
-		originalSize := comp.Height * comp.Width
-		compressedSize := len(comp.Qtable) + len(comp.EncQdiffs) + len(comp.Quarterimage)
-		ratio := float64(compressedSize) / float64(originalSize)
-		fmt.Printf("q: %v orig: %6dk diffs: %6dk comp: %6dk ratio: %.3f\n",
-			config.quantization, originalSize/1000, len(comp.EncQdiffs)/1000, compressedSize/1000, ratio)
+// Creates or truncates the file at path, or returns standard output if path is stdio.
+func createOutput(path string) (io.WriteCloser, error) {
+	if path == stdio {
+		return nopCloser{os.Stdout}, nil
+	}
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+}
 
-		outfile, err := os.OpenFile(config.outPath, os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			return
-		}
-		defer outfile.Close()
-		if err := gob.NewEncoder(outfile).Encode(comp); err != nil {
-			fmt.Println(err)
-			return
-		}
+type nopCloser struct {
+	io.Writer
+}
 
-	case modeDecrypt:
-		comp := &gshe.CompressedImage{}
-		infile, err := os.Open(config.inPath)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			return
-		}
-		defer infile.Close()
-		if err := gob.NewDecoder(infile).Decode(comp); err != nil {
-			fmt.Println(err)
-			return
-		}
+func (nopCloser) Close() error {
+	return nil
+}
 
-		dec, err := gshe.Decrypt(comp, []byte(config.key))
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+func readEncrypted(path string) (*gshe.EncryptedImage, error) {
+	data, err := readInput(path)
+	if err != nil {
+		return nil, err
+	}
+	enc := &gshe.EncryptedImage{}
+	if err := enc.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return enc, nil
+}
 
-		img := grayFromImage(dec)
-		outfile, err := os.OpenFile(config.outPath, os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-		defer outfile.Close()
-		if err := png.Encode(outfile, img); err != nil {
-			fmt.Println(err)
-			return
-		}
+func readCompressed(path string) (*gshe.CompressedImage, error) {
+	data, err := readInput(path)
+	if err != nil {
+		return nil, err
 	}
+	comp := &gshe.CompressedImage{}
+	if err := comp.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return comp, nil
+}
+
+func writeBinary(path string, v encoding.BinaryMarshaler) error {
+	data, err := v.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	f, err := createOutput(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
 func readGray(path string) (*image.Gray, error) {
-	f, err := os.Open(path)
+	data, err := readInput(path)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
 
-	src, _, err := image.Decode(f)
+	src, _, err := image.Decode(bytes.NewReader(data))
 	if err != nil {
 		return nil, err
 	}
@@ -279,6 +259,15 @@ func readGray(path string) (*image.Gray, error) {
 	return m, nil
 }
 
+// Reads the image at path as a gshe.Image.
+func readImage(path string) (*gshe.Image, error) {
+	src, err := readGray(path)
+	if err != nil {
+		return nil, err
+	}
+	return imageFromGray(src)
+}
+
 func imageFromGray(img *image.Gray) (*gshe.Image, error) {
 	return gshe.NewImage(img.Pix, img.Rect.Dx(), img.Rect.Dy())
 }
@@ -293,17 +282,31 @@ func grayFromImage(img *gshe.Image) *image.Gray {
 		dh = -1
 	}
 
-	g := image.NewGray(image.Rect(0, 0, img.Width+dw, img.Height+dh))
-	g.Pix = img.Image
-	return g
+	// The stride remains the padded width, the padding is cropped by Rect.
+	return &image.Gray{
+		Pix:    img.Image,
+		Stride: img.Width,
+		Rect:   image.Rect(0, 0, img.Width+dw, img.Height+dh),
+	}
 }
 
-func readKey(path string) ([]byte, error) {
-	src, err := os.Open(path)
-	if err != nil {
-		return nil, err
+// Asks whether to overwrite path if it already exists.
+func confirmOverwrite(path string) bool {
+	if path == stdio {
+		return true
+	}
+	if _, err := os.Stat(path); err != nil {
+		return true
+	}
+	fmt.Fprintf(os.Stderr, "Overwrite existing file %v? (y/[n]): ", path)
+	s := ""
+	fmt.Scanln(&s)
+	s = strings.ToLower(s)
+	switch s {
+	case "y":
+	case "yes":
+	default:
+		return false
 	}
-	defer src.Close()
-	dec := base64.NewDecoder(base64.StdEncoding, src)
-	return ioutil.ReadAll(dec)
+	return true
 }
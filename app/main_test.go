@@ -0,0 +1,27 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/Sinacam/gshe"
+)
+
+func TestExitCode(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		code int
+	}{
+		{errors.New("failed"), exitFailure},
+		{fmt.Errorf("x.gsc: %w", gshe.ErrWrongKey), exitWrongKey},
+		{&gshe.ErrCorruptPayload{Section: "qdiffs"}, exitCorrupt},
+		{fmt.Errorf("%w 2", gshe.ErrUnsupportedVersion), exitUnsupportedVersion},
+		{gshe.ErrInvalidDimensions, exitInvalidDimensions},
+		{gshe.ErrQuantization, exitQuantization},
+	} {
+		if code := exitCode(c.err); code != c.code {
+			t.Fatalf("%v\nexpect: %v\ngot: %v", c.err, c.code, code)
+		}
+	}
+}
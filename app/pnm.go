@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+)
+
+// Netpbm images, in plain (P1, P2, P3) and raw (P4, P5, P6) formats.
+// Bitmaps and greymaps decode to greyscale, pixmaps to colour,
+// with more than 8 bits if the maximum value is above 255.
+func init() {
+	for _, magic := range []string{"P1", "P2", "P3", "P4", "P5", "P6"} {
+		image.RegisterFormat("pnm", magic, decodePNM, decodePNMConfig)
+	}
+}
+
+type pnmHeader struct {
+	magic         byte // the digit after P
+	width, height int
+	maxval        int
+}
+
+func (h *pnmHeader) colorModel() color.Model {
+	switch {
+	case h.magic == '3' || h.magic == '6':
+		if h.maxval > 255 {
+			return color.RGBA64Model
+		}
+		return color.RGBAModel
+	case h.maxval > 255:
+		return color.Gray16Model
+	}
+	return color.GrayModel
+}
+
+func readPNMHeader(r *bufio.Reader) (*pnmHeader, error) {
+	magic := make([]byte, 2)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, err
+	}
+	if magic[0] != 'P' || magic[1] < '1' || magic[1] > '6' {
+		return nil, errors.New("pnm: invalid magic")
+	}
+
+	h := &pnmHeader{magic: magic[1], maxval: 1}
+	fields := []*int{&h.width, &h.height}
+	if h.magic != '1' && h.magic != '4' {
+		fields = append(fields, &h.maxval)
+	}
+	for _, f := range fields {
+		v, err := readPNMInt(r)
+		if err != nil {
+			return nil, err
+		}
+		*f = v
+	}
+	if h.width <= 0 || h.height <= 0 || h.maxval <= 0 || h.maxval > 65535 {
+		return nil, errors.New("pnm: invalid header")
+	}
+	if int64(h.width)*int64(h.height) > 1<<28 {
+		return nil, errors.New("pnm: image too large")
+	}
+	// A single whitespace separates the header from the raster.
+	if _, err := r.ReadByte(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Reads a decimal integer, skipping leading whitespace and comments.
+func readPNMInt(r *bufio.Reader) (int, error) {
+	c, err := r.ReadByte()
+	for ; err == nil; c, err = r.ReadByte() {
+		if c == '#' {
+			if _, err := r.ReadString('\n'); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if !isPNMSpace(c) {
+			break
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	if c < '0' || c > '9' {
+		return 0, fmt.Errorf("pnm: unexpected %q", c)
+	}
+
+	v := 0
+	for ; err == nil && c >= '0' && c <= '9'; c, err = r.ReadByte() {
+		v = 10*v + int(c-'0')
+		if v > 1<<24 {
+			return 0, errors.New("pnm: number too large")
+		}
+	}
+	if err == nil {
+		r.UnreadByte()
+	} else if err != io.EOF {
+		return 0, err
+	}
+	return v, nil
+}
+
+func isPNMSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func decodePNMConfig(r io.Reader) (image.Config, error) {
+	h, err := readPNMHeader(bufio.NewReader(r))
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: h.colorModel(), Width: h.width, Height: h.height}, nil
+}
+
+func decodePNM(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+	h, err := readPNMHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	channels := 1
+	if h.magic == '3' || h.magic == '6' {
+		channels = 3
+	}
+	n := h.width * h.height * channels
+
+	// Samples are only allocated as they are read,
+	// so that a header alone cannot claim much memory.
+	var samples []int
+	switch h.magic {
+	case '1', '2', '3':
+		for i := 0; i < n; i++ {
+			if h.magic == '1' {
+				// Plain bits need not be separated by whitespace.
+				c, err := br.ReadByte()
+				for err == nil && isPNMSpace(c) {
+					c, err = br.ReadByte()
+				}
+				if err != nil {
+					return nil, err
+				}
+				samples = append(samples, int(c-'0'))
+				continue
+			}
+			v, err := readPNMInt(br)
+			if err != nil {
+				return nil, err
+			}
+			samples = append(samples, v)
+		}
+
+	case '4':
+		stride := (h.width + 7) / 8
+		raster, err := readRaster(br, stride*h.height)
+		if err != nil {
+			return nil, err
+		}
+		samples = make([]int, n)
+		for y := 0; y < h.height; y++ {
+			row := raster[y*stride:]
+			for x := 0; x < h.width; x++ {
+				samples[y*h.width+x] = int(row[x/8]>>(7-x%8)) & 1
+			}
+		}
+
+	case '5', '6':
+		size := 1
+		if h.maxval > 255 {
+			size = 2
+		}
+		raster, err := readRaster(br, n*size)
+		if err != nil {
+			return nil, err
+		}
+		samples = make([]int, n)
+		for i := range samples {
+			if size == 1 {
+				samples[i] = int(raster[i])
+			} else {
+				samples[i] = int(raster[2*i])<<8 | int(raster[2*i+1])
+			}
+		}
+	}
+
+	for _, v := range samples {
+		if v > h.maxval {
+			return nil, errors.New("pnm: sample larger than maximum value")
+		}
+	}
+
+	// In bitmaps 1 is black.
+	if h.magic == '1' || h.magic == '4' {
+		for i := range samples {
+			samples[i] = 1 - samples[i]
+		}
+	}
+
+	rect := image.Rect(0, 0, h.width, h.height)
+	scale8 := func(v int) uint8 { return uint8((v*255 + h.maxval/2) / h.maxval) }
+	scale16 := func(v int) uint16 { return uint16((v*65535 + h.maxval/2) / h.maxval) }
+	switch h.colorModel() {
+	case color.GrayModel:
+		img := image.NewGray(rect)
+		for i, v := range samples {
+			img.Pix[i] = scale8(v)
+		}
+		return img, nil
+	case color.Gray16Model:
+		img := image.NewGray16(rect)
+		for i, v := range samples {
+			img.SetGray16(i%h.width, i/h.width, color.Gray16{scale16(v)})
+		}
+		return img, nil
+	case color.RGBAModel:
+		img := image.NewRGBA(rect)
+		for i := 0; i < len(samples)/3; i++ {
+			img.SetRGBA(i%h.width, i/h.width, color.RGBA{scale8(samples[3*i]), scale8(samples[3*i+1]), scale8(samples[3*i+2]), 255})
+		}
+		return img, nil
+	default:
+		img := image.NewRGBA64(rect)
+		for i := 0; i < len(samples)/3; i++ {
+			img.SetRGBA64(i%h.width, i/h.width, color.RGBA64{scale16(samples[3*i]), scale16(samples[3*i+1]), scale16(samples[3*i+2]), 65535})
+		}
+		return img, nil
+	}
+}
+
+// Reads n bytes, allocating only as much as is read.
+func readRaster(r io.Reader, n int) ([]byte, error) {
+	raster, err := ioutil.ReadAll(io.LimitReader(r, int64(n)))
+	if err != nil {
+		return nil, err
+	}
+	if len(raster) < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return raster, nil
+}
+
+// Encodes img as a raw 8 bit greymap.
+func encodePGM(w io.Writer, img *image.Gray) error {
+	b := img.Bounds()
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "P5\n%d %d\n255\n", b.Dx(), b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		off := img.PixOffset(b.Min.X, y)
+		bw.Write(img.Pix[off : off+b.Dx()])
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestDecodePNM(t *testing.T) {
+	expect := []byte{0, 255, 255, 0, 0, 255}
+	cases := map[string]string{
+		"plain bitmap":   "P1\n# comment\n3 2\n100\n110\n",
+		"packed bitmap":  "P1 3 2 100110",
+		"plain greymap":  "P2\n3 2\n4\n0 4 4\n0 0 4\n",
+		"raw bitmap":     "P4\n3 2\n\x80\xc0",
+		"raw greymap":    "P5\n3 2\n255\n\x00\xff\xff\x00\x00\xff",
+		"16 bit greymap": "P5\n3 2\n1023\n\x00\x00\x03\xff\x03\xff\x00\x00\x00\x00\x03\xff",
+		"plain pixmap":   "P3\n3 2\n1\n0 0 0 1 1 1 1 1 1\n0 0 0 0 0 0 1 1 1\n",
+		"raw pixmap":     "P6\n3 2\n255\n\x00\x00\x00\xff\xff\xff\xff\xff\xff\x00\x00\x00\x00\x00\x00\xff\xff\xff",
+	}
+	for name, data := range cases {
+		img, format, err := image.Decode(bytes.NewReader([]byte(data)))
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if format != "pnm" {
+			t.Fatalf("%v: decoded as %v", name, format)
+		}
+		got := make([]byte, 0, len(expect))
+		for y := 0; y < 2; y++ {
+			for x := 0; x < 3; x++ {
+				got = append(got, color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+			}
+		}
+		if !bytes.Equal(got, expect) {
+			t.Fatalf("%v:\nexpect: %v\ngot: %v", name, expect, got)
+		}
+	}
+}
+
+func TestDecodePNMInvalid(t *testing.T) {
+	cases := []string{
+		"P5\n3 2\n255\n\x00\xff",     // short raster
+		"P2\n3 2\n4\n0 4 5\n0 0 4\n", // sample above maximum
+		"P5\n0 2\n255\n",             // empty
+		"P5\n3 2\n70000\n",           // maximum too large
+		"P2\n3 x\n4\n",               // garbage
+		"P5\n99999 99999\n255\n\x00", // too large
+		"P6\n16384 16384\n255\n\x00", // large without raster
+		"P3\n16384 16384\n255\n1 2",  // large without samples
+	}
+	for _, data := range cases {
+		if _, _, err := image.Decode(bytes.NewReader([]byte(data))); err == nil {
+			t.Fatalf("decoded %q", data)
+		}
+	}
+}
+
+func TestEncodePGM(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 4, 3))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i * 20)
+	}
+	// Only the sub image is encoded.
+	sub := img.SubImage(image.Rect(1, 1, 3, 3)).(*image.Gray)
+
+	var buf bytes.Buffer
+	if err := encodePGM(&buf, sub); err != nil {
+		t.Fatal(err)
+	}
+	dec, err := decodePNM(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := dec.(*image.Gray)
+	expect := []byte{100, 120, 180, 200}
+	if got.Bounds() != image.Rect(0, 0, 2, 2) || !bytes.Equal(got.Pix, expect) {
+		t.Fatalf("\nexpect: %v\ngot: %v %v", expect, got.Bounds(), got.Pix)
+	}
+}
+
+// Decoding must not panic or allocate much more than the input needs,
+// and must agree with the decoded config.
+func FuzzDecodePNM(f *testing.F) {
+	f.Add([]byte("P1\n# comment\n3 2\n100\n110\n"))
+	f.Add([]byte("P2\n3 2\n4\n0 4 4\n0 0 4\n"))
+	f.Add([]byte("P4\n3 2\n\x80\xc0"))
+	f.Add([]byte("P5\n3 2\n1023\n\x00\x00\x03\xff\x03\xff\x00\x00\x00\x00\x03\xff"))
+	f.Add([]byte("P6\n1 1\n255\n\x00\xff\x00"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		config, err := decodePNMConfig(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		img, err := decodePNM(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if b := img.Bounds(); b.Dx() != config.Width || b.Dy() != config.Height || img.ColorModel() != config.ColorModel {
+			t.Fatalf("decoded %v %v, config %vx%v %v", b, img.ColorModel(), config.Width, config.Height, config.ColorModel)
+		}
+	})
+}
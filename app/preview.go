@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/Sinacam/gshe"
+)
+
+// Decrypts a half resolution preview of a compressed image.
+func runPreview(args []string) error {
+	fs := newFlagSet("preview", "[options] input_file...")
+	batch := addBatchFlags(fs, "_preview.png")
+	format := fs.String("format", "", "output format, one of png, pgm, tiff, bmp, default is by the output extension or png")
+	keys := addKeyFlags(fs)
+	fs.Parse(args)
+
+	outExt, err := outputExt(fs, *format)
+	if err != nil {
+		return err
+	}
+	jobs, err := batch.jobs(fs, fs.Args(), []string{".gsc"}, "_preview"+outExt)
+	if err != nil {
+		return err
+	}
+	key, err := keys.key(false)
+	if err != nil {
+		return err
+	}
+	defer zero(key)
+
+	return batch.run(jobs, func(in, out string) error {
+		comp, err := readCompressed(in)
+		if err != nil {
+			return err
+		}
+		dec, err := gshe.DecryptPreview(comp, key)
+		if err != nil {
+			return err
+		}
+		return writeImage(out, *format, dec)
+	})
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+
+	"github.com/Sinacam/gshe"
+	"github.com/Sinacam/gshe/metrics"
+)
+
+// rdpoint is the rate and distortion of one compression of an image.
+type rdpoint struct {
+	Coder        string
+	Quantization int
+	Bytes        int
+	BPP          float64
+	PSNR         float64
+	SSIM         float64
+}
+
+// Encrypts, compresses and decrypts an image at every quantization
+// and with the lossless coder, and prints the rate and distortion of each.
+func runRDCurve(args []string) error {
+	fs := newFlagSet("rdcurve", "[options] input_file")
+	outPath := fs.String("o", "", "path to output table, default is standard output")
+	keys := addKeyFlags(fs)
+	asJSON := fs.Bool("json", false, "output the table as JSON instead of CSV")
+	svgPath := fs.String("svg", "", "path to an SVG plot of PSNR against bits per pixel")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return newUsageError(fs, "no input file specified")
+	}
+
+	key, err := keys.key(false)
+	if err != nil {
+		return err
+	}
+	defer zero(key)
+
+	img, err := readImage(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	points, err := measureRD(img, key)
+	if err != nil {
+		return err
+	}
+
+	out := io.Writer(os.Stdout)
+	if *outPath != "" {
+		outfile, err := createOutput(*outPath)
+		if err != nil {
+			return err
+		}
+		defer outfile.Close()
+		out = outfile
+	}
+	if *asJSON {
+		err = writeRDJSON(out, points)
+	} else {
+		err = writeRDCSV(out, points)
+	}
+	if err != nil {
+		return err
+	}
+
+	if *svgPath != "" {
+		svgfile, err := createOutput(*svgPath)
+		if err != nil {
+			return err
+		}
+		defer svgfile.Close()
+		return writeRDSVG(svgfile, points)
+	}
+	return nil
+}
+
+// Measures every power of 2 quantization, then the lossless coder.
+// The bytes are those of the compressed file as written by the app.
+func measureRD(img *gshe.Image, key []byte) ([]rdpoint, error) {
+	pixels := img.Width * img.Height
+	if img.PadWidth {
+		pixels -= img.Height
+	}
+	if img.PadHeight {
+		pixels -= img.Width
+	}
+	if img.PadWidth && img.PadHeight {
+		pixels++
+	}
+
+	measure := func(coder string, q int, comp *gshe.CompressedImage) (rdpoint, error) {
+		data, err := comp.MarshalBinary()
+		if err != nil {
+			return rdpoint{}, err
+		}
+		dec, err := gshe.Decrypt(comp, key)
+		if err != nil {
+			return rdpoint{}, err
+		}
+		m, err := metrics.Compute(img, dec)
+		if err != nil {
+			return rdpoint{}, err
+		}
+		return rdpoint{
+			Coder:        coder,
+			Quantization: q,
+			Bytes:        len(data),
+			BPP:          float64(8*len(data)) / float64(pixels),
+			PSNR:         m.PSNR,
+			SSIM:         m.SSIM,
+		}, nil
+	}
+
+	var points []rdpoint
+	enc, err := gshe.Encrypt(img, key)
+	if err != nil {
+		return nil, err
+	}
+	for q := 1; q <= 128; q *= 2 {
+		comp, err := gshe.Compress(enc, uint8(q))
+		if err != nil {
+			return nil, err
+		}
+		p, err := measure("lossy", q, comp)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+
+	enc, err = gshe.EncryptLossless(img, key)
+	if err != nil {
+		return nil, err
+	}
+	comp, err := gshe.CompressLossless(enc)
+	if err != nil {
+		return nil, err
+	}
+	p, err := measure("lossless", 1, comp)
+	if err != nil {
+		return nil, err
+	}
+	return append(points, p), nil
+}
+
+func writeRDCSV(w io.Writer, points []rdpoint) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"coder", "quantization", "bytes", "bpp", "psnr", "ssim"})
+	for _, p := range points {
+		psnr := "inf"
+		if !math.IsInf(p.PSNR, 0) {
+			psnr = strconv.FormatFloat(p.PSNR, 'f', 4, 64)
+		}
+		cw.Write([]string{
+			p.Coder,
+			strconv.Itoa(p.Quantization),
+			strconv.Itoa(p.Bytes),
+			strconv.FormatFloat(p.BPP, 'f', 4, 64),
+			psnr,
+			strconv.FormatFloat(p.SSIM, 'f', 6, 64),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// An infinite PSNR is written as null, which JSON has no number for.
+func writeRDJSON(w io.Writer, points []rdpoint) error {
+	type jsonpoint struct {
+		Coder        string   `json:"coder"`
+		Quantization int      `json:"quantization"`
+		Bytes        int      `json:"bytes"`
+		BPP          float64  `json:"bpp"`
+		PSNR         *float64 `json:"psnr"`
+		SSIM         float64  `json:"ssim"`
+	}
+	jpoints := make([]jsonpoint, len(points))
+	for i, p := range points {
+		jpoints[i] = jsonpoint{Coder: p.Coder, Quantization: p.Quantization, Bytes: p.Bytes, BPP: p.BPP, SSIM: p.SSIM}
+		if !math.IsInf(p.PSNR, 0) {
+			jpoints[i].PSNR = &points[i].PSNR
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(jpoints)
+}
+
+// Plots PSNR against bits per pixel of the lossy points,
+// and the lossless point as a vertical line since its PSNR is infinite.
+func writeRDSVG(w io.Writer, points []rdpoint) error {
+	const (
+		width, height = 640, 400
+		left, right   = 60, 20
+		top, bottom   = 20, 50
+	)
+
+	maxBPP, minPSNR, maxPSNR := 0.0, math.Inf(1), math.Inf(-1)
+	for _, p := range points {
+		maxBPP = math.Max(maxBPP, p.BPP)
+		if !math.IsInf(p.PSNR, 0) {
+			minPSNR = math.Min(minPSNR, p.PSNR)
+			maxPSNR = math.Max(maxPSNR, p.PSNR)
+		}
+	}
+	if math.IsInf(minPSNR, 0) {
+		minPSNR, maxPSNR = 0, 0
+	}
+	maxBPP = math.Ceil(maxBPP)
+	if maxBPP == 0 {
+		maxBPP = 1
+	}
+	minPSNR = math.Floor(minPSNR/5) * 5
+	maxPSNR = math.Ceil(maxPSNR/5)*5 + 5
+
+	px := func(bpp float64) float64 {
+		return left + bpp/maxBPP*(width-left-right)
+	}
+	py := func(psnr float64) float64 {
+		return height - bottom - (psnr-minPSNR)/(maxPSNR-minPSNR)*(height-top-bottom)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" font-family=\"sans-serif\" font-size=\"12\">\n", width, height)
+	fmt.Fprintf(&b, "<rect width=\"%d\" height=\"%d\" fill=\"white\"/>\n", width, height)
+
+	// Axes, ticks and labels.
+	fmt.Fprintf(&b, "<path d=\"M%d %d V%d H%d\" stroke=\"black\" fill=\"none\"/>\n", left, top, height-bottom, width-right)
+	step := int(math.Ceil(maxBPP / 10))
+	for i := 0; i <= int(maxBPP); i += step {
+		x := px(float64(i))
+		fmt.Fprintf(&b, "<line x1=\"%.1f\" y1=\"%d\" x2=\"%.1f\" y2=\"%d\" stroke=\"black\"/>\n", x, height-bottom, x, height-bottom+5)
+		fmt.Fprintf(&b, "<text x=\"%.1f\" y=\"%d\" text-anchor=\"middle\">%d</text>\n", x, height-bottom+20, i)
+	}
+	for v := minPSNR; v <= maxPSNR; v += 5 {
+		y := py(v)
+		fmt.Fprintf(&b, "<line x1=\"%d\" y1=\"%.1f\" x2=\"%d\" y2=\"%.1f\" stroke=\"black\"/>\n", left-5, y, left, y)
+		fmt.Fprintf(&b, "<text x=\"%d\" y=\"%.1f\" text-anchor=\"end\">%g</text>\n", left-8, y+4, v)
+	}
+	fmt.Fprintf(&b, "<text x=\"%d\" y=\"%d\" text-anchor=\"middle\">bits per pixel</text>\n", (left+width-right)/2, height-10)
+	fmt.Fprintf(&b, "<text transform=\"translate(15 %d) rotate(-90)\" text-anchor=\"middle\">PSNR (dB)</text>\n", (top+height-bottom)/2)
+
+	// Lossy curve with the quantization of every point.
+	fmt.Fprint(&b, "<polyline fill=\"none\" stroke=\"steelblue\" stroke-width=\"2\" points=\"")
+	for _, p := range points {
+		if p.Coder == "lossy" {
+			fmt.Fprintf(&b, "%.1f,%.1f ", px(p.BPP), py(p.PSNR))
+		}
+	}
+	fmt.Fprint(&b, "\"/>\n")
+	for _, p := range points {
+		x := px(p.BPP)
+		if p.Coder == "lossy" {
+			y := py(p.PSNR)
+			fmt.Fprintf(&b, "<circle cx=\"%.1f\" cy=\"%.1f\" r=\"3\" fill=\"steelblue\"/>\n", x, y)
+			fmt.Fprintf(&b, "<text x=\"%.1f\" y=\"%.1f\">q=%d</text>\n", x+5, y-5, p.Quantization)
+		} else {
+			fmt.Fprintf(&b, "<line x1=\"%.1f\" y1=\"%d\" x2=\"%.1f\" y2=\"%d\" stroke=\"firebrick\" stroke-dasharray=\"4 4\"/>\n", x, top, x, height-bottom)
+			fmt.Fprintf(&b, "<text x=\"%.1f\" y=\"%d\" text-anchor=\"end\">%s</text>\n", x-5, top+12, p.Coder)
+		}
+	}
+	fmt.Fprint(&b, "</svg>\n")
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRDCurve(t *testing.T) {
+	img, err := syntheticImage(64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	points, err := measureRD(img, []byte("rdcurve key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every power of 2 quantization, then the lossless coder.
+	if len(points) != 9 {
+		t.Fatalf("\nexpect: %v points\ngot: %v", 9, len(points))
+	}
+	for i, p := range points[:8] {
+		if p.Coder != "lossy" || p.Quantization != 1<<i || math.IsInf(p.PSNR, 0) {
+			t.Fatalf("\nexpect: lossy q=%v with finite PSNR\ngot: %+v", 1<<i, p)
+		}
+	}
+	lossless := points[8]
+	if lossless.Coder != "lossless" || !math.IsInf(lossless.PSNR, 1) {
+		t.Fatalf("\nexpect: lossless with infinite PSNR\ngot: %+v", lossless)
+	}
+
+	// The quality increases towards smaller quantizations, then lossless,
+	// which must not take fewer bytes.
+	for i := 1; i < 8; i++ {
+		if points[i-1].Bytes < points[i].Bytes {
+			t.Fatalf("q=%v takes fewer bytes than q=%v\nexpect: at least %v\ngot: %v",
+				points[i-1].Quantization, points[i].Quantization, points[i].Bytes, points[i-1].Bytes)
+		}
+	}
+	if lossless.Bytes < points[0].Bytes {
+		t.Fatalf("lossless takes fewer bytes than q=1\nexpect: at least %v\ngot: %v", points[0].Bytes, lossless.Bytes)
+	}
+
+	var out bytes.Buffer
+	if err := writeRDCSV(&out, points); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1+len(points) || records[0][4] != "psnr" {
+		t.Fatalf("\nexpect: a header and %v rows\ngot: %v", len(points), records)
+	}
+	for _, r := range records[1:9] {
+		if _, err := strconv.ParseFloat(r[4], 64); err != nil {
+			t.Fatalf("\nexpect: a finite PSNR\ngot: %v", r)
+		}
+	}
+	if psnr := records[9][4]; psnr != "inf" {
+		t.Fatalf("\nexpect: %v\ngot: %v", "inf", psnr)
+	}
+
+	out.Reset()
+	if err := writeRDJSON(&out, points); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"psnr": null`) {
+		t.Fatalf("\nexpect: %v\ngot: %v", `"psnr": null`, out.String())
+	}
+	var decoded []struct {
+		Coder        string   `json:"coder"`
+		Quantization int      `json:"quantization"`
+		Bytes        int      `json:"bytes"`
+		PSNR         *float64 `json:"psnr"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(points) {
+		t.Fatalf("\nexpect: %v points\ngot: %v", len(points), len(decoded))
+	}
+	for i, p := range decoded {
+		if p.Coder != points[i].Coder || p.Quantization != points[i].Quantization || p.Bytes != points[i].Bytes {
+			t.Fatalf("\nexpect: %+v\ngot: %+v", points[i], p)
+		}
+		if (p.PSNR == nil) != (i == 8) || (p.PSNR != nil && *p.PSNR != points[i].PSNR) {
+			t.Fatalf("\nexpect: %+v\ngot: %v", points[i], p.PSNR)
+		}
+	}
+
+	out.Reset()
+	if err := writeRDSVG(&out, points); err != nil {
+		t.Fatal(err)
+	}
+	dec := xml.NewDecoder(&out)
+	root := ""
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if start, ok := tok.(xml.StartElement); ok && root == "" {
+			root = start.Name.Local
+		}
+	}
+	if root != "svg" {
+		t.Fatalf("\nexpect: %v\ngot: %v", "svg", root)
+	}
+}
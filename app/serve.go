@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Sinacam/gshe/server"
+)
+
+// Serves compression of encrypted images over HTTP until interrupted.
+func runServe(args []string) error {
+	fs := newFlagSet("serve", "[options]")
+	addr := fs.String("addr", "localhost:8080", "address to listen on")
+	maxBody := fs.Int64("max-body", server.DefaultMaxBodyBytes, "largest accepted encrypted image in bytes")
+	workers := fs.Int("j", server.DefaultMaxConcurrent, "number of compressions run at the same time")
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		return newUsageError(fs, "unexpected arguments")
+	}
+	if *maxBody <= 0 {
+		return newUsageError(fs, "invalid -max-body")
+	}
+	if *workers < 1 {
+		return newUsageError(fs, "invalid number of workers")
+	}
+
+	srv := &http.Server{
+		Addr: *addr,
+		Handler: server.New(&server.Config{
+			MaxBodyBytes:  *maxBody,
+			MaxConcurrent: *workers,
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	done := make(chan error, 1)
+	go func() {
+		<-stop
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		done <- srv.Shutdown(ctx)
+	}()
+
+	fmt.Fprintf(os.Stderr, "listening on %v\n", *addr)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return <-done
+}
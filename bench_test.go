@@ -0,0 +1,179 @@
+package gshe
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/Sinacam/gshe/internal/testimage"
+)
+
+// Sides of the square images of the benchmarks, from 256x256 to 8192x8192.
+var benchSizes = []int{256, 512, 1024, 2048, 4096, 8192}
+
+var benchKey = []byte("I am probably a secretive secret")
+
+var benchImages = map[int]*Image{}
+
+// Returns a size x size image with smooth regions, edges and noise,
+// which is generated once for all the benchmarks.
+func benchImage(b *testing.B, size int) *Image {
+	if img, ok := benchImages[size]; ok {
+		return img
+	}
+	img, err := NewImage(testimage.Synthetic(size), size, size)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchImages[size] = img
+	return img
+}
+
+// Runs f for every size, with throughput in bytes of the image.
+func benchSizesOf(b *testing.B, f func(b *testing.B, img *Image)) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprintf("%vx%v", size, size), func(b *testing.B) {
+			img := benchImage(b, size)
+			b.SetBytes(int64(len(img.Image)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			f(b, img)
+		})
+	}
+}
+
+func BenchmarkEncrypt(b *testing.B) {
+	benchSizesOf(b, func(b *testing.B, img *Image) {
+		for i := 0; i < b.N; i++ {
+			if _, err := Encrypt(img, benchKey); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkCompress(b *testing.B) {
+	benchSizesOf(b, func(b *testing.B, img *Image) {
+		b.StopTimer()
+		enc, err := Encrypt(img, benchKey)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := Compress(enc, 4); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkCompressLossless(b *testing.B) {
+	benchSizesOf(b, func(b *testing.B, img *Image) {
+		b.StopTimer()
+		enc, err := EncryptLossless(img, benchKey)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := CompressLossless(enc); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkDecrypt(b *testing.B) {
+	benchSizesOf(b, func(b *testing.B, img *Image) {
+		b.StopTimer()
+		enc, err := Encrypt(img, benchKey)
+		if err != nil {
+			b.Fatal(err)
+		}
+		comp, err := Compress(enc, 4)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := Decrypt(comp, benchKey); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// The KDF is independent of the image, and dominates small images.
+func BenchmarkNewRNG(b *testing.B) {
+	salt := make([]byte, 16)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := newRNG(benchKey, salt, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPermuteHalfimage(b *testing.B) {
+	benchSizesOf(b, func(b *testing.B, img *Image) {
+		halfimage := make([]byte, len(img.Image)/2)
+		rng := rand.New(rand.NewSource(1))
+		for i := 0; i < b.N; i++ {
+			permuteHalfimage(halfimage, rng)
+		}
+	})
+}
+
+func BenchmarkUnpermuteBlocks(b *testing.B) {
+	benchSizesOf(b, func(b *testing.B, img *Image) {
+		blocks := make([][4]byte, len(img.Image)/4)
+		unpermuted := make([][4]byte, len(blocks))
+		indices := make([]int, len(blocks))
+		rng := rand.New(rand.NewSource(1))
+		for i := 0; i < b.N; i++ {
+			unpermuteBlocks(unpermuted, blocks, indices, rng)
+		}
+	})
+}
+
+func BenchmarkMakeQtable(b *testing.B) {
+	distortions := make([]int, 256)
+	rng := rand.New(rand.NewSource(1))
+	for i := range distortions {
+		distortions[i] = rng.Intn(1 << 20)
+	}
+	qtable := make([]byte, 256)
+	for _, q := range []uint8{1, 4, 16, 128} {
+		b.Run(fmt.Sprintf("q%v", q), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				makeQtable(qtable, distortions, q)
+			}
+		})
+	}
+}
+
+func BenchmarkInterpolate(b *testing.B) {
+	for _, ip := range []struct {
+		name         string
+		interpolator Interpolator
+	}{
+		{"CAI", CAI{}},
+		{"CAI-threshold", CAI{Threshold: 8}},
+		{"Bilinear", Bilinear{}},
+		{"Bicubic", Bicubic{}},
+		{"EdgeDirected", EdgeDirected{}},
+	} {
+		b.Run(ip.name, func(b *testing.B) {
+			benchSizesOf(b, func(b *testing.B, img *Image) {
+				// The missing pixels are overwritten every time,
+				// so the same image can be interpolated repeatedly.
+				dec := &Image{Image: append([]byte(nil), img.Image...), Width: img.Width, Height: img.Height}
+				for i := 0; i < b.N; i++ {
+					ip.interpolator.Interpolate(dec)
+				}
+			})
+		})
+	}
+}
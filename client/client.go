@@ -0,0 +1,238 @@
+// Package client is a client of the compression service of package server.
+//
+// Client has the same methods as the compression functions of gshe,
+// so that local and remote compression are interchangeable as a gshe.Compressor.
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sinacam/gshe"
+)
+
+// Compressor is implemented by both Client and the local gshe.CompressOptions.
+type Compressor = gshe.Compressor
+
+var _ Compressor = (*Client)(nil)
+
+// Defaults of Client.
+const (
+	DefaultMaxRetries = 3
+	DefaultBackoff    = 100 * time.Millisecond
+	DefaultMaxBackoff = 5 * time.Second
+)
+
+// Client compresses encrypted images on a server.
+// Zero values of the fields are replaced by the defaults.
+type Client struct {
+	// BaseURL is the URL of the server, such as http://localhost:8080.
+	BaseURL string
+
+	// HTTPClient is used for requests, http.DefaultClient if nil.
+	HTTPClient *http.Client
+
+	// MaxRetries is the number of retries of a failed request,
+	// negative for none. Compression is idempotent, so requests failing
+	// from the network or a busy server are retried.
+	MaxRetries int
+
+	// Backoff is the wait before the first retry, which doubles every retry
+	// up to MaxBackoff. A Retry-After of the server takes precedence.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// New returns a client of the server at baseURL.
+func New(baseURL string) *Client {
+	return &Client{BaseURL: baseURL}
+}
+
+// Compress compresses img on the server with quantization.
+func (c *Client) Compress(img *gshe.EncryptedImage, quantization uint8) (*gshe.CompressedImage, error) {
+	return c.CompressContext(context.Background(), img, quantization)
+}
+
+// CompressLossless compresses img on the server without loss.
+func (c *Client) CompressLossless(img *gshe.EncryptedImage) (*gshe.CompressedImage, error) {
+	return c.CompressLosslessContext(context.Background(), img)
+}
+
+// CompressContext is Compress with a context bounding all the attempts.
+func (c *Client) CompressContext(ctx context.Context, img *gshe.EncryptedImage, quantization uint8) (*gshe.CompressedImage, error) {
+	query := url.Values{"q": {strconv.Itoa(int(quantization))}}
+	comp, err := c.compress(ctx, img, query)
+	if err != nil {
+		return nil, err
+	}
+	if err := validate(img, comp, quantization, false); err != nil {
+		return nil, err
+	}
+	return comp, nil
+}
+
+// CompressLosslessContext is CompressLossless with a context bounding all the attempts.
+func (c *Client) CompressLosslessContext(ctx context.Context, img *gshe.EncryptedImage) (*gshe.CompressedImage, error) {
+	comp, err := c.compress(ctx, img, url.Values{"lossless": {"1"}})
+	if err != nil {
+		return nil, err
+	}
+	if err := validate(img, comp, 1, true); err != nil {
+		return nil, err
+	}
+	return comp, nil
+}
+
+// StatusError is the response of the server to a failed request.
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("server: %v: %v", http.StatusText(e.StatusCode), e.Message)
+}
+
+// ErrMismatch is returned when the server responds with a compressed image
+// that cannot be the compression of the uploaded image.
+var ErrMismatch = errors.New("compressed image does not match the encrypted image")
+
+// Checks that comp can be the compression of img.
+func validate(img *gshe.EncryptedImage, comp *gshe.CompressedImage, quantization uint8, lossless bool) error {
+	switch {
+	case comp.Width != img.Width || comp.Height != img.Height:
+		return fmt.Errorf("%w: dimensions %vx%v, expect %vx%v", ErrMismatch, comp.Width, comp.Height, img.Width, img.Height)
+	case comp.PadWidth != img.PadWidth || comp.PadHeight != img.PadHeight:
+		return fmt.Errorf("%w: padding", ErrMismatch)
+	case !bytes.Equal(comp.Salt, img.Salt):
+		return fmt.Errorf("%w: salt", ErrMismatch)
+	case !bytes.Equal(comp.KeyCheck, img.KeyCheck):
+		return fmt.Errorf("%w: key check", ErrMismatch)
+	case len(comp.Quarterimage) != len(img.Halfimage)/2:
+		return fmt.Errorf("%w: quarterimage size", ErrMismatch)
+	case quantization != 0 && len(comp.Qtable) != 256/int(quantization):
+		return fmt.Errorf("%w: quantization", ErrMismatch)
+	case lossless && len(comp.EncResiduals) == 0:
+		return fmt.Errorf("%w: not lossless", ErrMismatch)
+	}
+	return nil
+}
+
+func (c *Client) compress(ctx context.Context, img *gshe.EncryptedImage, query url.Values) (*gshe.CompressedImage, error) {
+	u := strings.TrimRight(c.BaseURL, "/") + "/compress?" + query.Encode()
+	retries := c.MaxRetries
+	if retries == 0 {
+		retries = DefaultMaxRetries
+	}
+
+	for attempt := 0; ; attempt++ {
+		comp, retryAfter, err := c.post(ctx, u, img)
+		if err == nil {
+			return comp, nil
+		}
+		if retryAfter < 0 || attempt >= retries || ctx.Err() != nil {
+			return nil, err
+		}
+
+		wait := c.backoff(attempt)
+		if retryAfter > 0 {
+			wait = retryAfter
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, err
+		case <-t.C:
+		}
+	}
+}
+
+// Returns the wait before retry attempt+1, with jitter
+// so that clients failing together do not retry together.
+func (c *Client) backoff(attempt int) time.Duration {
+	d, limit := c.Backoff, c.MaxBackoff
+	if d <= 0 {
+		d = DefaultBackoff
+	}
+	if limit <= 0 {
+		limit = DefaultMaxBackoff
+	}
+	for i := 0; i < attempt && d < limit; i++ {
+		d *= 2
+	}
+	if d > limit {
+		d = limit
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Makes a single request. The returned duration is negative if the request
+// should not be retried, or the Retry-After of the server if there is one.
+func (c *Client) post(ctx context.Context, u string, img *gshe.EncryptedImage) (*gshe.CompressedImage, time.Duration, error) {
+	// The body is encoded while it is uploaded instead of being buffered.
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := img.WriteTo(pw)
+		pw.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, pr)
+	if err != nil {
+		pr.Close()
+		return nil, -1, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		// Network errors are retried.
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		err := &StatusError{resp.StatusCode, strings.TrimSpace(string(data))}
+		switch resp.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return nil, retryAfter(resp), err
+		}
+		return nil, -1, err
+	}
+
+	comp := &gshe.CompressedImage{}
+	if err := comp.UnmarshalBinary(data); err != nil {
+		return nil, -1, err
+	}
+	return comp, 0, nil
+}
+
+// Returns the Retry-After of resp in seconds, or 0 if there is none.
+func retryAfter(resp *http.Response) time.Duration {
+	s, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || s < 0 {
+		return 0
+	}
+	return time.Duration(s) * time.Second
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
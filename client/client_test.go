@@ -0,0 +1,168 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Sinacam/gshe"
+	"github.com/Sinacam/gshe/server"
+)
+
+func testImage(t *testing.T, seed byte) *gshe.EncryptedImage {
+	key := []byte("I am probably a secretive secret")
+	payload := make([]byte, 15*9)
+	for i := range payload {
+		payload[i] = byte(i*7) + seed
+	}
+	img, err := gshe.NewImage(payload, 15, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := gshe.EncryptLossless(img, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return enc
+}
+
+// Returns a handler failing the first n requests with code.
+func flaky(n int32, code int, h http.Handler, requests *int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(requests, 1) <= n {
+			http.Error(w, "try again", code)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func TestCompressor(t *testing.T) {
+	ts := httptest.NewServer(server.New(nil))
+	defer ts.Close()
+	enc := testImage(t, 0)
+
+	for _, c := range []Compressor{&gshe.CompressOptions{}, New(ts.URL)} {
+		comp, err := c.Compress(enc, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(comp.Qtable) != 64 {
+			t.Fatalf("\nexpect: %v\ngot: %v", 64, len(comp.Qtable))
+		}
+		comp, err = c.CompressLossless(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(comp.EncResiduals) == 0 {
+			t.Fatal("lossless compression has no residuals")
+		}
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	var chunked bool
+	h := server.New(nil)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunked = r.ContentLength == -1
+		h.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	if _, err := New(ts.URL).Compress(testImage(t, 0), 1); err != nil {
+		t.Fatal(err)
+	}
+	if !chunked {
+		t.Fatal("body was not streamed")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(flaky(2, http.StatusServiceUnavailable, server.New(nil), &requests))
+	defer ts.Close()
+
+	c := &Client{BaseURL: ts.URL, Backoff: time.Millisecond}
+	if _, err := c.Compress(testImage(t, 0), 2); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 3 {
+		t.Fatalf("\nexpect: %v\ngot: %v", 3, requests)
+	}
+
+	// Exhausting the retries returns the last error.
+	requests = 0
+	c.MaxRetries = 1
+	_, err := c.Compress(testImage(t, 0), 2)
+	var serr *StatusError
+	if !errors.As(err, &serr) || serr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("\nexpect: %v\ngot: %v", http.StatusServiceUnavailable, err)
+	}
+	if requests != 2 {
+		t.Fatalf("\nexpect: %v\ngot: %v", 2, requests)
+	}
+}
+
+func TestNoRetry(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(flaky(1, http.StatusBadRequest, server.New(nil), &requests))
+	defer ts.Close()
+
+	c := &Client{BaseURL: ts.URL, Backoff: time.Millisecond}
+	_, err := c.Compress(testImage(t, 0), 2)
+	var serr *StatusError
+	if !errors.As(err, &serr) || serr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("\nexpect: %v\ngot: %v", http.StatusBadRequest, err)
+	}
+	if requests != 1 {
+		t.Fatalf("\nexpect: %v\ngot: %v", 1, requests)
+	}
+}
+
+func TestRetryContext(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(flaky(100, http.StatusServiceUnavailable, server.New(nil), &requests))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	c := &Client{BaseURL: ts.URL, MaxRetries: 100, Backoff: time.Hour}
+	start := time.Now()
+	if _, err := c.CompressContext(ctx, testImage(t, 0), 2); err == nil {
+		t.Fatal("expect error")
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Fatal("backoff ignored the context")
+	}
+}
+
+func TestMismatch(t *testing.T) {
+	// A server compressing some other image.
+	other, err := gshe.Compress(testImage(t, 1), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := other.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer ts.Close()
+
+	c := New(ts.URL)
+	if _, err := c.Compress(testImage(t, 0), 4); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("\nexpect: %v\ngot: %v", ErrMismatch, err)
+	}
+	if _, err := c.Compress(testImage(t, 1), 8); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("\nexpect: %v\ngot: %v", ErrMismatch, err)
+	}
+	if _, err := c.CompressLossless(testImage(t, 1)); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("\nexpect: %v\ngot: %v", ErrMismatch, err)
+	}
+}
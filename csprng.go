@@ -33,6 +33,7 @@ package gshe
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"io"
@@ -62,10 +63,34 @@ func (dz devZero) Read(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
-func newRNG(key, salt []byte) io.Reader {
-	seed := pbkdf2.Key(key, salt, 4096, 32, sha256.New)
-	block, _ := aes.NewCipher(seed)
+// KDF derives the seed of the keystream masking and permuting an image
+// from the key and the salt. The seed must be 16, 24 or 32 bytes long.
+// An image must be decrypted with the KDF it was encrypted with.
+type KDF func(key, salt []byte) []byte
+
+// PBKDF2 is the default KDF, PBKDF2 with SHA-256 and 4096 iterations.
+func PBKDF2(key, salt []byte) []byte {
+	return pbkdf2.Key(key, salt, 4096, 32, sha256.New)
+}
+
+// Returns the keystream of key and salt derived by kdf, or PBKDF2 if nil,
+// along with the key check value stored in images.
+// The key check is a MAC of a constant under the seed, so it reveals nothing
+// about the keystream but tells whether a key is the one that was used.
+func newRNG(key, salt []byte, kdf KDF) (io.Reader, []byte, error) {
+	if kdf == nil {
+		kdf = PBKDF2
+	}
+	seed := kdf(key, salt)
+	block, err := aes.NewCipher(seed)
+	if err != nil {
+		return nil, nil, err
+	}
 	stream := cipher.NewCTR(block, make([]byte, 16))
 
-	return cipher.StreamReader{S: stream, R: devZero{}}
+	mac := hmac.New(sha256.New, seed)
+	mac.Write([]byte("gshe key check"))
+	check := mac.Sum(nil)[:8]
+
+	return cipher.StreamReader{S: stream, R: devZero{}}, check, nil
 }
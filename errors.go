@@ -0,0 +1,68 @@
+package gshe
+
+import (
+	"crypto/hmac"
+	"errors"
+	"fmt"
+)
+
+// Errors of the package, which may be wrapped with details.
+// Test for them with errors.Is.
+var (
+	// ErrInvalidDimensions is returned when the dimensions of an image
+	// do not match its data.
+	ErrInvalidDimensions = errors.New("invalid image dimensions")
+
+	// ErrQuantization is returned when the quantization is not a power of 2,
+	// or is not 1 for lossless compression.
+	ErrQuantization = errors.New("invalid quantization")
+
+	// ErrWrongKey is returned when decrypting with another key or KDF
+	// than the image was encrypted with. It is only detected for images
+	// with a KeyCheck, which older images do not have.
+	ErrWrongKey = errors.New("wrong key")
+
+	// ErrUnsupportedVersion is returned when decoding an image
+	// of a format version newer than FormatVersion.
+	ErrUnsupportedVersion = errors.New("unsupported format version")
+)
+
+// ErrCorruptPayload is returned when a section of an encoded image
+// cannot be decoded. Test for it with errors.As, or with errors.Is
+// against an ErrCorruptPayload with the same Section or an empty one.
+type ErrCorruptPayload struct {
+	// Section is the corrupt part of the image: header, gob, halfimage,
+	// antidiagonal, quarterimage, qtable, qdiffs, residuals or key check.
+	Section string
+
+	// Err is the underlying error, if any.
+	Err error
+}
+
+func (e *ErrCorruptPayload) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("corrupt %v", e.Section)
+	}
+	return fmt.Sprintf("corrupt %v: %v", e.Section, e.Err)
+}
+
+func (e *ErrCorruptPayload) Unwrap() error {
+	return e.Err
+}
+
+func (e *ErrCorruptPayload) Is(target error) bool {
+	t, ok := target.(*ErrCorruptPayload)
+	return ok && (t.Section == "" || t.Section == e.Section)
+}
+
+func corrupt(section string, err error) error {
+	return &ErrCorruptPayload{Section: section, Err: err}
+}
+
+// Returns ErrWrongKey if the key check of an image does not match the one derived.
+func checkKey(stored, derived []byte) error {
+	if len(stored) > 0 && !hmac.Equal(stored, derived) {
+		return ErrWrongKey
+	}
+	return nil
+}
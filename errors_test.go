@@ -0,0 +1,73 @@
+package gshe
+
+import (
+	"errors"
+	"image"
+	"testing"
+)
+
+func TestErrInvalidDimensions(t *testing.T) {
+	if _, err := NewImage(make([]byte, 10), 3, 3); !errors.Is(err, ErrInvalidDimensions) {
+		t.Fatalf("\nexpect: %v\ngot: %v", ErrInvalidDimensions, err)
+	}
+}
+
+func TestErrQuantization(t *testing.T) {
+	enc, _ := testImages(t)
+	if _, err := Compress(enc, 3); !errors.Is(err, ErrQuantization) {
+		t.Fatalf("\nexpect: %v\ngot: %v", ErrQuantization, err)
+	}
+	if _, err := CompressWithOptions(enc, 4, &CompressOptions{Lossless: true}); !errors.Is(err, ErrQuantization) {
+		t.Fatalf("\nexpect: %v\ngot: %v", ErrQuantization, err)
+	}
+}
+
+func TestErrWrongKey(t *testing.T) {
+	_, comp := testImages(t)
+	key := []byte("I am not the secret")
+
+	if _, err := Decrypt(comp, key); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("\nexpect: %v\ngot: %v", ErrWrongKey, err)
+	}
+	if _, err := DecryptRegion(comp, key, image.Rect(0, 0, 4, 4)); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("\nexpect: %v\ngot: %v", ErrWrongKey, err)
+	}
+	if _, err := DecryptPreview(comp, key); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("\nexpect: %v\ngot: %v", ErrWrongKey, err)
+	}
+
+	// Without a key check the wrong key cannot be told apart.
+	comp.KeyCheck = nil
+	if _, err := Decrypt(comp, key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestErrCorruptPayload(t *testing.T) {
+	enc, comp := testImages(t)
+
+	data, err := enc.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = (&CompressedImage{}).UnmarshalBinary(data)
+	var cerr *ErrCorruptPayload
+	if !errors.As(err, &cerr) || cerr.Section != "header" {
+		t.Fatalf("\nexpect: corrupt header\ngot: %v", err)
+	}
+
+	err = (&EncryptedImage{}).UnmarshalBinary(data[:len(data)/2])
+	if !errors.Is(err, &ErrCorruptPayload{Section: "gob"}) {
+		t.Fatalf("\nexpect: corrupt gob\ngot: %v", err)
+	}
+	if errors.Is(err, &ErrCorruptPayload{Section: "qdiffs"}) {
+		t.Fatal("corrupt gob is corrupt qdiffs")
+	}
+
+	key := []byte("I am probably a secretive secret")
+	comp.EncQdiffs = comp.EncQdiffs[:len(comp.EncQdiffs)/2]
+	_, err = Decrypt(comp, key)
+	if !errors.Is(err, &ErrCorruptPayload{}) || !errors.Is(err, &ErrCorruptPayload{Section: "qdiffs"}) {
+		t.Fatalf("\nexpect: corrupt qdiffs\ngot: %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package gshe
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	fselib "github.com/Sinacam/gshe/FiniteStateEntropy/lib"
+)
+
+// Encoded images start with a magic for their kind followed by
+// a byte of the format version, then the gob encoded image.
+// Images encoded before the header existed are bare gob and are version 0.
+// The magic starts with 0x89 which cannot start a gob stream.
+const (
+	encryptedMagic  = "\x89GSE"
+	compressedMagic = "\x89GSC"
+
+	// FormatVersion is the version of the format written by MarshalBinary.
+	FormatVersion = 1
+)
+
+func init() {
+	// Gob numbers types in the order they are first encoded, and the numbers
+	// are part of the encoding. Encoding both kinds once fixes their numbers,
+	// so that an image always encodes to the same bytes.
+	(&EncryptedImage{}).WriteTo(ioutil.Discard)
+	(&CompressedImage{}).WriteTo(ioutil.Discard)
+}
+
+// Kind is the kind of an encoded image.
+type Kind int
+
+const (
+	KindUnknown Kind = iota
+	KindEncrypted
+	KindCompressed
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindEncrypted:
+		return "encrypted"
+	case KindCompressed:
+		return "compressed"
+	}
+	return "unknown"
+}
+
+// Returns the kind and format version of an encoded image from its first bytes.
+// The kind of version 0 images is recognized by the type name in the gob stream,
+// which is within the first 64 bytes.
+func Sniff(data []byte) (Kind, int) {
+	if len(data) >= len(encryptedMagic)+1 {
+		version := int(data[len(encryptedMagic)])
+		switch string(data[:len(encryptedMagic)]) {
+		case encryptedMagic:
+			return KindEncrypted, version
+		case compressedMagic:
+			return KindCompressed, version
+		}
+	}
+
+	if len(data) > 64 {
+		data = data[:64]
+	}
+	switch {
+	case bytes.Contains(data, []byte("EncryptedImage")):
+		return KindEncrypted, 0
+	case bytes.Contains(data, []byte("CompressedImage")):
+		return KindCompressed, 0
+	}
+	return KindUnknown, 0
+}
+
+// Encodes the image with a header of the current format version.
+func (img *EncryptedImage) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := img.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Writes the encoding of MarshalBinary to w without buffering it.
+func (img *EncryptedImage) WriteTo(w io.Writer) (int64, error) {
+	// The conversion drops the methods, otherwise gob calls MarshalBinary.
+	type plain EncryptedImage
+	return writeTo(w, encryptedMagic, (*plain)(img))
+}
+
+// Decodes an image of any format version up to FormatVersion, and validates it.
+func (img *EncryptedImage) UnmarshalBinary(data []byte) error {
+	type plain EncryptedImage
+	if err := unmarshal(encryptedMagic, data, (*plain)(img)); err != nil {
+		return err
+	}
+	return img.Validate()
+}
+
+// Encodes the image with a header of the current format version.
+func (img *CompressedImage) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := img.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Writes the encoding of MarshalBinary to w without buffering it.
+func (img *CompressedImage) WriteTo(w io.Writer) (int64, error) {
+	type plain CompressedImage
+	return writeTo(w, compressedMagic, (*plain)(img))
+}
+
+// Decodes an image of any format version up to FormatVersion, and validates it.
+func (img *CompressedImage) UnmarshalBinary(data []byte) error {
+	type plain CompressedImage
+	if err := unmarshal(compressedMagic, data, (*plain)(img)); err != nil {
+		return err
+	}
+	return img.Validate()
+}
+
+func writeTo(w io.Writer, magic string, v interface{}) (int64, error) {
+	cw := &countingWriter{w: w}
+	if _, err := cw.Write(append([]byte(magic), FormatVersion)); err != nil {
+		return cw.n, err
+	}
+	err := gob.NewEncoder(cw).Encode(v)
+	return cw.n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func unmarshal(magic string, data []byte, v interface{}) error {
+	switch {
+	case len(data) > 0 && data[0] != magic[0]:
+		// version 0 without header
+	case len(data) < len(magic)+1 || string(data[:len(magic)]) != magic:
+		return corrupt("header", errors.New("not an encoded image of this kind"))
+	case data[len(magic)] > FormatVersion:
+		return fmt.Errorf("%w %v", ErrUnsupportedVersion, data[len(magic)])
+	default:
+		data = data[len(magic)+1:]
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(v); err != nil {
+		return corrupt("gob", err)
+	}
+	return nil
+}
+
+// Decodes the quantized differences, i.e. indexes into Qtable.
+func (img *CompressedImage) DecodeQdiffs() ([]byte, error) {
+	return img.decodeQdiffs(nil)
+}
+
+// Decodes the quantized differences into the buffer of qdiffs.
+func (img *CompressedImage) decodeQdiffs(qdiffs []byte) ([]byte, error) {
+	qdiffs = grow(qdiffs, len(img.Quarterimage))
+	n, err := fselib.Decode(qdiffs, img.EncQdiffs)
+	if err != nil {
+		return nil, corrupt("qdiffs", err)
+	}
+	return qdiffs[:n], nil
+}
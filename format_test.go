@@ -0,0 +1,191 @@
+package gshe
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io"
+	"testing"
+)
+
+func testImages(t testing.TB) (*EncryptedImage, *CompressedImage) {
+	key := []byte("I am probably a secretive secret")
+	payload := make([]byte, 15*9)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	img, err := NewImage(payload, 15, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := EncryptLossless(img, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp, err := Compress(enc, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return enc, comp
+}
+
+// Compares the images by their encodings, since reflect is shadowed in the package.
+func equalGob(t *testing.T, a, b interface{ MarshalBinary() ([]byte, error) }) bool {
+	da, err := a.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := b.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Equal(da, db)
+}
+
+func TestMarshalBinary(t *testing.T) {
+	enc, comp := testImages(t)
+
+	data, err := enc.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind, version := Sniff(data); kind != KindEncrypted || version != FormatVersion {
+		t.Fatalf("\nexpect: %v %v\ngot: %v %v", KindEncrypted, FormatVersion, kind, version)
+	}
+	gotEnc := &EncryptedImage{}
+	if err := gotEnc.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !equalGob(t, gotEnc, enc) {
+		t.Fatalf("\nexpect: %v\ngot: %v", enc, gotEnc)
+	}
+	if err := (&CompressedImage{}).UnmarshalBinary(data); err == nil {
+		t.Fatal("encrypted image decoded as compressed")
+	}
+
+	data, err = comp.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind, version := Sniff(data); kind != KindCompressed || version != FormatVersion {
+		t.Fatalf("\nexpect: %v %v\ngot: %v %v", KindCompressed, FormatVersion, kind, version)
+	}
+	gotComp := &CompressedImage{}
+	if err := gotComp.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !equalGob(t, gotComp, comp) {
+		t.Fatalf("\nexpect: %v\ngot: %v", comp, gotComp)
+	}
+}
+
+// Returns the bare gob of the images as written by the app before the header,
+// with the same type names.
+func legacyGob(t *testing.T, enc *EncryptedImage, comp *CompressedImage) ([]byte, []byte) {
+	type EncryptedImage struct {
+		Halfimage           []byte
+		Width, Height       int
+		PadWidth, PadHeight bool
+		Salt                []byte
+		Antidiagonal        []byte
+	}
+	type CompressedImage struct {
+		Quarterimage        []byte
+		Qtable              []byte
+		EncQdiffs           []byte
+		Salt                []byte
+		Width, Height       int
+		PadWidth, PadHeight bool
+		EncResiduals        []byte
+	}
+
+	legacyEnc := &EncryptedImage{enc.Halfimage, enc.Width, enc.Height, enc.PadWidth, enc.PadHeight, enc.Salt, enc.Antidiagonal}
+	legacyComp := &CompressedImage{comp.Quarterimage, comp.Qtable, comp.EncQdiffs, comp.Salt,
+		comp.Width, comp.Height, comp.PadWidth, comp.PadHeight, comp.EncResiduals}
+
+	var encbuf, compbuf bytes.Buffer
+	if err := gob.NewEncoder(&encbuf).Encode(legacyEnc); err != nil {
+		t.Fatal(err)
+	}
+	if err := gob.NewEncoder(&compbuf).Encode(legacyComp); err != nil {
+		t.Fatal(err)
+	}
+	return encbuf.Bytes(), compbuf.Bytes()
+}
+
+func TestWriteTo(t *testing.T) {
+	enc, comp := testImages(t)
+	for _, img := range []interface {
+		MarshalBinary() ([]byte, error)
+		WriteTo(io.Writer) (int64, error)
+	}{enc, comp} {
+		expect, err := img.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		n, err := img.WriteTo(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(expect)) || !bytes.Equal(buf.Bytes(), expect) {
+			t.Fatalf("\nexpect: %v bytes\ngot: %v bytes %v written", len(expect), buf.Len(), n)
+		}
+	}
+}
+
+func TestUnmarshalLegacy(t *testing.T) {
+	enc, comp := testImages(t)
+	// Legacy images have no key check.
+	enc.KeyCheck, comp.KeyCheck = nil, nil
+	encdata, compdata := legacyGob(t, enc, comp)
+
+	if kind, version := Sniff(encdata); kind != KindEncrypted || version != 0 {
+		t.Fatalf("\nexpect: %v %v\ngot: %v %v", KindEncrypted, 0, kind, version)
+	}
+	gotEnc := &EncryptedImage{}
+	if err := gotEnc.UnmarshalBinary(encdata); err != nil {
+		t.Fatal(err)
+	}
+	if !equalGob(t, gotEnc, enc) {
+		t.Fatalf("\nexpect: %v\ngot: %v", enc, gotEnc)
+	}
+
+	if kind, version := Sniff(compdata); kind != KindCompressed || version != 0 {
+		t.Fatalf("\nexpect: %v %v\ngot: %v %v", KindCompressed, 0, kind, version)
+	}
+	gotComp := &CompressedImage{}
+	if err := gotComp.UnmarshalBinary(compdata); err != nil {
+		t.Fatal(err)
+	}
+	if !equalGob(t, gotComp, comp) {
+		t.Fatalf("\nexpect: %v\ngot: %v", comp, gotComp)
+	}
+}
+
+func TestUnmarshalUnsupportedVersion(t *testing.T) {
+	_, comp := testImages(t)
+	data, err := comp.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(compressedMagic)] = FormatVersion + 1
+	if err := (&CompressedImage{}).UnmarshalBinary(data); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("\nexpect: %v\ngot: %v", ErrUnsupportedVersion, err)
+	}
+}
+
+func TestDecodeQdiffs(t *testing.T) {
+	_, comp := testImages(t)
+	qdiffs, err := comp.DecodeQdiffs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := decodeCompressed(comp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(qdiffs, dec.Qdiffs) {
+		t.Fatalf("\nexpect: %v\ngot: %v", dec.Qdiffs, qdiffs)
+	}
+}
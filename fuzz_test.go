@@ -0,0 +1,196 @@
+package gshe
+
+import (
+	"bytes"
+	"image"
+	"testing"
+
+	fselib "github.com/Sinacam/gshe/FiniteStateEntropy/lib"
+)
+
+// Encoded images seeding the fuzz targets besides the corpus in testdata/fuzz.
+func fuzzSeeds(t testing.TB) (enc, comp, lossless []byte) {
+	key := []byte("I am probably a secretive secret")
+	img, err := NewImage([]byte("Do I look like a real image to you??"), 6, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := EncryptLossless(img, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Compress(e, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := CompressLossless(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enc, err = e.MarshalBinary(); err != nil {
+		t.Fatal(err)
+	}
+	if comp, err = c.MarshalBinary(); err != nil {
+		t.Fatal(err)
+	}
+	if lossless, err = l.MarshalBinary(); err != nil {
+		t.Fatal(err)
+	}
+	return enc, comp, lossless
+}
+
+// Decoding the container must not panic,
+// and whatever decodes must encode and decode again.
+func FuzzUnmarshal(f *testing.F) {
+	enc, comp, lossless := fuzzSeeds(f)
+	f.Add(enc)
+	f.Add(comp)
+	f.Add(lossless)
+	f.Add([]byte(encryptedMagic))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		Sniff(data)
+
+		e := &EncryptedImage{}
+		if err := e.UnmarshalBinary(data); err == nil {
+			again, err := e.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := (&EncryptedImage{}).UnmarshalBinary(again); err != nil {
+				t.Fatal(err)
+			}
+			Compress(e, 1)
+			CompressLossless(e)
+		}
+
+		c := &CompressedImage{}
+		if err := c.UnmarshalBinary(data); err == nil {
+			again, err := c.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := (&CompressedImage{}).UnmarshalBinary(again); err != nil {
+				t.Fatal(err)
+			}
+			c.DecodeQdiffs()
+		}
+	})
+}
+
+// Decrypting arbitrary compressed images must fail or succeed without panicking.
+// The image is built from its fields rather than decoded,
+// so that the fuzzer does not need to get the gob encoding right.
+func FuzzDecrypt(f *testing.F) {
+	key := []byte("I am probably a secretive secret")
+	enc, _ := testImages(f)
+	for _, q := range []uint8{1, 4, 0} {
+		var c *CompressedImage
+		var err error
+		if q == 0 {
+			c, err = CompressLossless(enc)
+		} else {
+			c, err = Compress(enc, q)
+		}
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(c.Width, c.Height, c.PadWidth, c.PadHeight, c.Quarterimage, c.Qtable, c.EncQdiffs, c.EncResiduals, c.Salt, key, 1, 1, 5, 5)
+	}
+
+	f.Fuzz(func(t *testing.T, width, height int, padWidth, padHeight bool, quarterimage, qtable, qdiffs, residuals, salt, key []byte, x0, y0, x1, y1 int) {
+		c := &CompressedImage{
+			Quarterimage: quarterimage,
+			Qtable:       qtable,
+			EncQdiffs:    qdiffs,
+			EncResiduals: residuals,
+			Salt:         salt,
+			Width:        width,
+			Height:       height,
+			PadWidth:     padWidth,
+			PadHeight:    padHeight,
+		}
+		dec, err := Decrypt(c, key)
+		if err == nil && (dec.Width != c.Width || dec.Height != c.Height || len(dec.Image) != c.Width*c.Height) {
+			t.Fatalf("decrypted %vx%v with %v bytes from %vx%v", dec.Width, dec.Height, len(dec.Image), c.Width, c.Height)
+		}
+		DecryptPreview(c, key)
+		DecryptRegion(c, key, image.Rect(x0, y0, x1, y1))
+		DecryptWithOptions(c, key, &DecryptOptions{Iterations: 1, Interpolator: EdgeDirected{}})
+	})
+}
+
+// Encrypting, compressing and decrypting random images must recover
+// the pixels that are kept, or all of them if lossless.
+func FuzzRoundTrip(f *testing.F) {
+	f.Add([]byte("Do I look like a real image to you??"), uint8(6), []byte("key"), uint8(1), false)
+	f.Add([]byte("Do I look like a real image to you??"), uint8(5), []byte(""), uint8(8), false)
+	f.Add([]byte{0, 255, 255, 0, 1}, uint8(1), []byte("key"), uint8(1), true)
+
+	f.Fuzz(func(t *testing.T, payload []byte, width uint8, key []byte, quantization uint8, lossless bool) {
+		if width == 0 || len(payload) < int(width) {
+			return
+		}
+		w, h := int(width), len(payload)/int(width)
+		img, err := NewImage(payload[:w*h], w, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		enc, err := EncryptWithOptions(img, key, &EncryptOptions{Lossless: lossless})
+		if err != nil {
+			t.Fatal(err)
+		}
+		comp, err := CompressWithOptions(enc, quantization, &CompressOptions{Lossless: lossless})
+		if err != nil {
+			if lossless && quantization != 1 || quantization&(quantization-1) != 0 || quantization == 0 {
+				return
+			}
+			t.Fatal(err)
+		}
+		dec, err := Decrypt(comp, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if lossless {
+			if !bytes.Equal(dec.Image, img.Image) {
+				t.Fatalf("\nexpect: %v\ngot: %v", img.Image, dec.Image)
+			}
+			return
+		}
+		// The top left pixel of every block is kept exactly.
+		for y := 0; y < img.Height; y += 2 {
+			for x := 0; x < img.Width; x += 2 {
+				if dec.At(x, y) != img.At(x, y) {
+					t.Fatalf("(%v, %v)\nexpect: %v\ngot: %v", x, y, img.At(x, y), dec.At(x, y))
+				}
+			}
+		}
+	})
+}
+
+// The entropy coder must decode what it encodes, and not panic on anything else.
+func FuzzEntropyCoder(f *testing.F) {
+	f.Add([]byte("Do I look like a real image to you??"))
+	f.Add(make([]byte, 64))
+	f.Add([]byte{1})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decoded := make([]byte, 2*len(data)+16)
+		fselib.Decode(decoded, data)
+
+		encoded := make([]byte, len(data)+16)
+		n, err := fselib.Encode(encoded, data)
+		if err != nil {
+			return
+		}
+		n, err = fselib.Decode(decoded, encoded[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded[:n], data) {
+			t.Fatalf("\nexpect: %v\ngot: %v", data, decoded[:n])
+		}
+	})
+}
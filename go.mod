@@ -2,4 +2,10 @@ module github.com/Sinacam/gshe
 
 go 1.18
 
-require golang.org/x/crypto v0.0.0-20220518034528-6f7dac969898
+require (
+	golang.org/x/crypto v0.0.0-20220518034528-6f7dac969898
+	golang.org/x/image v0.0.0-20220413100746-70e8d0d3baa9
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
+)
+
+require golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
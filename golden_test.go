@@ -0,0 +1,395 @@
+package gshe
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	fselib "github.com/Sinacam/gshe/FiniteStateEntropy/lib"
+)
+
+// The golden vectors in testdata/golden are images encrypted, compressed and
+// decrypted when the vector was added, which every later version must
+// reproduce so that archived files stay decryptable. Each vector is a
+// directory testdata/golden/v<format version>/<name> of
+//
+//	key             the key
+//	input.pgm       the image
+//	encrypted.gse   the encrypted image
+//	compressed.gsc  the compressed image
+//	decrypted.pgm   the decrypted image
+//
+// The version 0 vectors are written by the app of the first version of gshe
+// with testdata/golden/v0/generate.sh, so their images are PNG files as that
+// app reads and writes them. Missing vectors of the current format version
+// are written by go test -run TestGolden -update. Existing files are never
+// overwritten, so a deliberate change of the default decryption must replace
+// the decrypted images it changes by hand.
+var updateGolden = flag.Bool("update", false, "write missing golden vectors in testdata/golden")
+
+type goldenVector struct {
+	version int
+	name    string
+
+	// Whether the image has a key check, which version 1 images
+	// written before the key check existed do not have.
+	keyCheck bool
+
+	width, height int
+	lossless      bool // encrypted losslessly
+	quantization  uint8
+	compLossless  bool // compressed losslessly
+	decrypt       *DecryptOptions
+}
+
+// Vectors must not be removed or changed once added, add new ones instead.
+var goldenVectors = []goldenVector{
+	// The baseline decrypted with CAI of threshold 20 and mirrored borders.
+	// The default decryption changed since, estimating the thresholds and
+	// extrapolating the borders, so it no longer reproduces decrypted.png
+	// of version 0 vectors on purpose. These options still must.
+	{version: 0, name: "q1", width: 16, height: 12, quantization: 1, decrypt: baselineDecrypt},
+	{version: 0, name: "q4", width: 24, height: 16, quantization: 4, decrypt: baselineDecrypt},
+	{version: 1, name: "no-key-check-q4", width: 16, height: 12, quantization: 4},
+	{version: 1, name: "q1", keyCheck: true, width: 16, height: 12, quantization: 1},
+	{version: 1, name: "q4", keyCheck: true, width: 24, height: 16, quantization: 4},
+	{version: 1, name: "q16-refine", keyCheck: true, width: 24, height: 16, quantization: 16,
+		decrypt: &DecryptOptions{Iterations: 2}},
+	{version: 1, name: "lossless", keyCheck: true, width: 15, height: 9, lossless: true, quantization: 1, compLossless: true},
+	{version: 1, name: "lossless-q8", keyCheck: true, width: 16, height: 12, lossless: true, quantization: 8},
+	{version: 1, name: "odd-bilinear", keyCheck: true, width: 17, height: 11, quantization: 2,
+		decrypt: &DecryptOptions{Interpolator: Bilinear{}}},
+}
+
+// The decryption options of the baseline.
+var baselineDecrypt = &DecryptOptions{Threshold: 20, Border: BorderMirror}
+
+// The compressed vectors depend on the entropy coder, which is the separate
+// FiniteStateEntropy library. They must be written with the real library,
+// whose fingerprint is kept in testdata/golden/coder, and are only compared
+// when the coder has that fingerprint. When they are missing or the coder
+// differs, the test fails if the environment variable CI is set, and skips
+// the comparison otherwise.
+const goldenCoderPath = "testdata/golden/coder"
+
+// Returns the fingerprint of the entropy coder, and whether it compresses
+// at all, which a stand-in for the library does not.
+func goldenCoder(t *testing.T) (string, bool) {
+	probe := make([]byte, 4096)
+	rng := rand.New(rand.NewSource(1))
+	for i := range probe {
+		probe[i] = byte(rng.NormFloat64() * 8)
+	}
+	enc := make([]byte, len(probe))
+	n, err := fselib.Encode(enc, probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(enc[:n])
+	// The probe has an entropy of about 5 bits per byte.
+	return hex.EncodeToString(sum[:8]), n < len(probe)*3/4
+}
+
+// Fails in CI, where the compressed vectors must be compared, and skips otherwise.
+func goldenIncomplete(t *testing.T, format string, args ...interface{}) {
+	if os.Getenv("CI") != "" {
+		t.Fatalf(format, args...)
+	}
+	t.Skipf(format, args...)
+}
+
+// Returns an image with smooth regions, edges and noise.
+func goldenInput(width, height int) []byte {
+	data := make([]byte, width*height)
+	rng := rand.New(rand.NewSource(int64(width*height + 1)))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := 40 + 6*x + 3*y + rng.Intn(9)
+			if x > width/2 && y > height/3 {
+				v += 90
+			}
+			data[y*width+x] = byte(clamp(v, 0, 255))
+		}
+	}
+	return data
+}
+
+func TestGolden(t *testing.T) {
+	coder, compresses := goldenCoder(t)
+	stored, err := ioutil.ReadFile(goldenCoderPath)
+	if os.IsNotExist(err) && *updateGolden && compresses {
+		if err := ioutil.WriteFile(goldenCoderPath, []byte(coder+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		stored, err = []byte(coder), nil
+	}
+	sameCoder := err == nil && strings.TrimSpace(string(stored)) == coder
+
+	for _, v := range goldenVectors {
+		v := v
+		t.Run(fmt.Sprintf("v%v/%v", v.version, v.name), func(t *testing.T) {
+			dir := filepath.Join("testdata", "golden", fmt.Sprintf("v%v", v.version), v.name)
+			if *updateGolden {
+				writeGolden(t, v, dir, sameCoder)
+			}
+			checkGolden(t, v, dir, sameCoder)
+		})
+	}
+}
+
+// Writes the missing files of the vector, the compressed image only with the real coder.
+func writeGolden(t *testing.T, v goldenVector, dir string, sameCoder bool) {
+	if v.version != FormatVersion {
+		// These are written by the version that wrote the format, never by this one.
+		return
+	}
+
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		key := []byte("golden key of " + v.name)
+		input := goldenInput(v.width, v.height)
+		img, err := NewImage(input, v.width, v.height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc := goldenEncrypt(t, v, img, key, saltOf(v))
+		encdata, err := enc.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dec, err := decrypt(goldenCompress(t, v, enc), key, v.decrypt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, filepath.Join(dir, "key"), key)
+		writeFile(t, filepath.Join(dir, "input.pgm"), encodePGM(input, v.width, v.height))
+		writeFile(t, filepath.Join(dir, "encrypted.gse"), encdata)
+		data, w, h := cropped(dec)
+		writeFile(t, filepath.Join(dir, "decrypted.pgm"), encodePGM(data, w, h))
+	}
+
+	path := filepath.Join(dir, "compressed.gsc")
+	if _, err := os.Stat(path); !os.IsNotExist(err) || !sameCoder {
+		return
+	}
+	enc := &EncryptedImage{}
+	if err := enc.UnmarshalBinary(readGolden(t, dir, "encrypted.gse")); err != nil {
+		t.Fatal(err)
+	}
+	comp, err := CompressWithOptions(enc, v.quantization, &CompressOptions{Lossless: v.compLossless})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compdata, err := comp.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, path, compdata)
+}
+
+func saltOf(v goldenVector) []byte {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("v%v/%v", v.version, v.name)))
+	return sum[:16]
+}
+
+// Returns the encryption of the vector by the current version with the given salt.
+func goldenEncrypt(t *testing.T, v goldenVector, img *Image, key, salt []byte) *EncryptedImage {
+	defer func(gen func() ([]byte, error)) { genSalt = gen }(genSalt)
+	genSalt = func() ([]byte, error) { return append([]byte(nil), salt...), nil }
+
+	enc, err := EncryptWithOptions(img, key, &EncryptOptions{Lossless: v.lossless})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.keyCheck {
+		enc.KeyCheck = nil
+	}
+	return enc
+}
+
+// Returns the compression of the vector without the entropy coder.
+func goldenCompress(t *testing.T, v goldenVector, enc *EncryptedImage) *compressedImage {
+	var c *compressedImage
+	var err error
+	if v.compLossless {
+		c, err = compressLossless(enc)
+	} else {
+		c, err = compress(enc, v.quantization)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func checkGolden(t *testing.T, v goldenVector, dir string, sameCoder bool) {
+	key := readGolden(t, dir, "key")
+	input, w, h := readGoldenImage(t, v, dir, "input")
+	expectDec, _, _ := readGoldenImage(t, v, dir, "decrypted")
+	encdata := readGolden(t, dir, "encrypted.gse")
+
+	if kind, version := Sniff(encdata); kind != KindEncrypted || version != v.version {
+		t.Fatalf("\nexpect: %v %v\ngot: %v %v", KindEncrypted, v.version, kind, version)
+	}
+	goldenEnc := &EncryptedImage{}
+	if err := goldenEnc.UnmarshalBinary(encdata); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := NewImage(input, w, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := goldenEncrypt(t, v, img, key, goldenEnc.Salt)
+
+	// Encryption involves no entropy coding, so it must reproduce the vector exactly.
+	if !equalGob(t, enc, goldenEnc) {
+		t.Fatalf("encryption changed\nexpect: %v\ngot: %v", goldenEnc, enc)
+	}
+	if v.version == FormatVersion {
+		data, err := enc.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, encdata) {
+			t.Fatalf("encoding of encrypted image changed\nexpect: %x\ngot: %x", encdata, data)
+		}
+	}
+
+	// So must decryption of the compression of the golden encrypted image,
+	// which is done here without the coder.
+	dec, err := decrypt(goldenCompress(t, v, goldenEnc), key, v.decrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _, _ := cropped(dec); !bytes.Equal(data, expectDec) {
+		t.Fatalf("decryption changed\nexpect: %v\ngot: %v", expectDec, data)
+	}
+
+	compdata, err := ioutil.ReadFile(filepath.Join(dir, "compressed.gsc"))
+	if os.IsNotExist(err) {
+		goldenIncomplete(t, "%v/compressed.gsc is missing, write it with the real FiniteStateEntropy", dir)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if !sameCoder {
+		goldenIncomplete(t, "the entropy coder is not the one in %v, check out the real FiniteStateEntropy", goldenCoderPath)
+	}
+
+	if kind, version := Sniff(compdata); kind != KindCompressed || version != v.version {
+		t.Fatalf("\nexpect: %v %v\ngot: %v %v", KindCompressed, v.version, kind, version)
+	}
+	goldenComp := &CompressedImage{}
+	if err := goldenComp.UnmarshalBinary(compdata); err != nil {
+		t.Fatal(err)
+	}
+	comp, err := CompressWithOptions(goldenEnc, v.quantization, &CompressOptions{Lossless: v.compLossless})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalGob(t, comp, goldenComp) {
+		t.Fatalf("compression changed\nexpect: %v\ngot: %v", goldenComp, comp)
+	}
+	if v.version == FormatVersion {
+		data, err := comp.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, compdata) {
+			t.Fatalf("encoding of compressed image changed\nexpect: %x\ngot: %x", compdata, data)
+		}
+	}
+	dec, err = DecryptWithOptions(goldenComp, key, v.decrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _, _ := cropped(dec); !bytes.Equal(data, expectDec) {
+		t.Fatalf("decryption changed\nexpect: %v\ngot: %v", expectDec, data)
+	}
+}
+
+// Reads the image name of the vector, a PNG for version 0 and a PGM otherwise.
+func readGoldenImage(t *testing.T, v goldenVector, dir, name string) ([]byte, int, int) {
+	if v.version != 0 {
+		return readPGM(t, filepath.Join(dir, name+".pgm"))
+	}
+	src, err := png.Decode(bytes.NewReader(readGolden(t, dir, name+".png")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gray, ok := src.(*image.Gray)
+	if !ok {
+		t.Fatalf("%v/%v.png: not greyscale", dir, name)
+	}
+	w, h := gray.Rect.Dx(), gray.Rect.Dy()
+	data := make([]byte, 0, w*h)
+	for y := 0; y < h; y++ {
+		data = append(data, gray.Pix[y*gray.Stride:y*gray.Stride+w]...)
+	}
+	return data, w, h
+}
+
+// Returns the image without padding.
+func cropped(img *Image) ([]byte, int, int) {
+	w, h := img.Width, img.Height
+	if img.PadWidth {
+		w--
+	}
+	if img.PadHeight {
+		h--
+	}
+	data := make([]byte, 0, w*h)
+	for y := 0; y < h; y++ {
+		data = append(data, img.Image[y*img.Width:y*img.Width+w]...)
+	}
+	return data, w, h
+}
+
+func encodePGM(data []byte, width, height int) []byte {
+	return append([]byte(fmt.Sprintf("P5\n%v %v\n255\n", width, height)), data...)
+}
+
+// Reads a PGM as written by encodePGM.
+func readPGM(t *testing.T, path string) ([]byte, int, int) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var w, h, maxval int
+	r := bytes.NewReader(data)
+	if _, err := fmt.Fscanf(r, "P5\n%d %d\n%d\n", &w, &h, &maxval); err != nil || maxval != 255 {
+		t.Fatalf("%v: not a PGM written by encodePGM: %v", path, err)
+	}
+	pixels := data[len(data)-r.Len():]
+	if len(pixels) != w*h {
+		t.Fatalf("%v: %v bytes for %vx%v", path, len(pixels), w, h)
+	}
+	return pixels, w, h
+}
+
+func readGolden(t *testing.T, dir, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatalf("%v, write missing vectors as described at updateGolden", err)
+	}
+	return data
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
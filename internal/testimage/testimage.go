@@ -0,0 +1,24 @@
+// Package testimage generates the images of the benchmarks and tests.
+//
+// It returns pixels rather than images, so that the tests of package gshe
+// can use it without an import cycle.
+package testimage
+
+import "math/rand"
+
+// Synthetic returns the pixels of a size x size image with smooth regions,
+// edges and noise. The same size always gives the same pixels.
+func Synthetic(size int) []byte {
+	data := make([]byte, size*size)
+	rng := rand.New(rand.NewSource(int64(size)))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			v := (x+y)*128/size + rng.Intn(8)
+			if (x/64+y/64)%2 == 0 {
+				v += 96
+			}
+			data[y*size+x] = byte(v)
+		}
+	}
+	return data
+}
@@ -0,0 +1,587 @@
+package gshe
+
+import "math"
+
+// Interpolator reconstructs the pixels discarded by compression.
+//
+// The image passed to Interpolate has the top left and bottom right pixel of
+// each 2x2 block decrypted, i.e. every pixel (x, y) where x+y is even.
+// Interpolate fills in the remaining pixels in place.
+type Interpolator interface {
+	Interpolate(img *Image)
+}
+
+// CAI is context adaptive interpolation, the default interpolator.
+// It averages all neighbours in smooth regions, averages along edges,
+// and takes the median of the neighbours otherwise.
+type CAI struct {
+	// Threshold is applied to the entire image.
+	// Differences between neighbouring pixels at most Threshold are treated as noise,
+	// larger ones as edges.
+	// If zero, each block takes the threshold that best predicts the known pixels around it,
+	// so the threshold 0 itself is selected by a ThresholdMap returning 0.
+	Threshold int
+
+	// ThresholdMap returns the threshold for the 2x2 block whose top left pixel is (x, y).
+	// Overrides Threshold if not nil.
+	ThresholdMap func(x, y int) int
+
+	// Border selects how neighbours outside of the image are treated.
+	Border Border
+
+	// buf is the buffer of estimateThresholds, which is allocated every time if nil.
+	buf *thresholdBuffers
+}
+
+// Border selects how CAI treats neighbours outside of the image.
+type Border int
+
+const (
+	// BorderExtrapolate linearly extrapolates the two nearest known pixels
+	// in the direction of the missing neighbour, clamped to [0, 255].
+	// This reconstructs gradients along and across the border, and is the default.
+	BorderExtrapolate Border = iota
+
+	// BorderMirror mirrors the image about its first and last rows and columns.
+	// The missing neighbour becomes a copy of the opposite neighbour,
+	// which turns gradients across the border into false extrema.
+	BorderMirror
+
+	// BorderReplicate repeats the known pixels on the border of the image.
+	BorderReplicate
+
+	// BorderCAI3 interpolates from the neighbours inside the image only.
+	// In the corners, the two remaining neighbours are averaged.
+	BorderCAI3
+)
+
+// Bilinear averages the four neighbours of each pixel.
+type Bilinear struct{}
+
+// Bicubic averages cubic interpolations along the row and the column of each pixel.
+type Bicubic struct{}
+
+// EdgeDirected is new edge-directed interpolation (NEDI).
+// The weights of the four neighbours of each pixel are fitted to the
+// surrounding known pixels, which follows edges in any direction.
+// It is considerably slower than the other interpolators.
+type EdgeDirected struct{}
+
+func (c CAI) Interpolate(img *Image) {
+	var threshold func(x, y int) int
+	switch {
+	case c.ThresholdMap != nil:
+		threshold = c.ThresholdMap
+	case c.Threshold != 0:
+		threshold = func(x, y int) int {
+			return c.Threshold
+		}
+	default:
+		estimate := estimateThresholds(img, c.buf)
+		threshold = func(x, y int) int {
+			return estimate(x/2, y/2)
+		}
+	}
+
+	for y := 0; y < img.Height; y++ {
+		for x := 1 - y%2; x < img.Width; x += 2 {
+			inside := x > 0 && y > 0 && x < img.Width-1 && y < img.Height-1
+			switch {
+			case inside:
+				img.Image[y*img.Width+x] = cai(img.neighbors(x, y), threshold(x&^1, y&^1))
+			case c.Border == BorderCAI3:
+				img.Image[y*img.Width+x] = caiInside(img, x, y, threshold(x&^1, y&^1))
+			default:
+				neighbors := [4]byte{
+					img.borderAt(x, y-1, c.Border),
+					img.borderAt(x+1, y, c.Border),
+					img.borderAt(x, y+1, c.Border),
+					img.borderAt(x-1, y, c.Border),
+				}
+				img.Image[y*img.Width+x] = cai(neighbors, threshold(x&^1, y&^1))
+			}
+		}
+	}
+}
+
+// Interpolates pixel (x, y) with cai from its neighbours inside of the image.
+func caiInside(img *Image, x, y, threshold int) byte {
+	var inside [4]bool
+	var neighbors [4]byte
+	n := 0
+	for i, d := range [4][2]int{{0, -1}, {1, 0}, {0, 1}, {-1, 0}} {
+		u, v := x+d[0], y+d[1]
+		if u >= 0 && v >= 0 && u < img.Width && v < img.Height {
+			inside[i] = true
+			neighbors[i] = img.At(u, v)
+			n++
+		}
+	}
+
+	switch n {
+	case 4:
+		return cai(neighbors, threshold)
+	case 3:
+		missing := 0
+		for inside[missing] {
+			missing++
+		}
+		return cai3(neighbors, missing, threshold)
+	}
+
+	// In a corner, or an image only 2 pixels wide or high.
+	sum := 0
+	for i := range neighbors {
+		sum += int(neighbors[i])
+	}
+	return byte((sum + n/2) / n)
+}
+
+// Context Adaptive Interpolation with the neighbour at index missing unavailable.
+// The remaining neighbours are one opposite of the missing neighbour
+// and a pair across.
+func cai3(neighbors [4]byte, missing, threshold int) byte {
+	opposite := neighbors[(missing+2)%4]
+	a, b := neighbors[(missing+1)%4], neighbors[(missing+3)%4]
+	min, max, _ := minmaxmedian([4]byte{opposite, a, b, a})
+
+	// returned values are all rounded to nearest
+	if int(max)-int(min) <= threshold {
+		sum := int(opposite) + int(a) + int(b)
+		return byte((sum + 1) / 3)
+	}
+	// An edge between the pair means the pixel lies along the edge
+	// through the opposite neighbour.
+	if absdiff(a, b) > threshold {
+		return opposite
+	}
+	sum := int(a) + int(b)
+	return byte((sum + 1) / 2)
+}
+
+func (Bilinear) Interpolate(img *Image) {
+	for y := 0; y < img.Height; y++ {
+		for x := 1 - y%2; x < img.Width; x += 2 {
+			img.Image[y*img.Width+x] = mean(img.neighbors(x, y))
+		}
+	}
+}
+
+func (Bicubic) Interpolate(img *Image) {
+	for y := 0; y < img.Height; y++ {
+		for x := 1 - y%2; x < img.Width; x += 2 {
+			// Cubic interpolation halfway between samples has weights (-1, 9, 9, -1)/16.
+			at := img.mirrorAt
+			h := 9*(int(at(x-1, y))+int(at(x+1, y))) - int(at(x-3, y)) - int(at(x+3, y))
+			v := 9*(int(at(x, y-1))+int(at(x, y+1))) - int(at(x, y-3)) - int(at(x, y+3))
+			img.Image[y*img.Width+x] = byte(clamp((h+v+16)/32, 0, 255))
+		}
+	}
+}
+
+// Radius of the window of known pixels the weights of EdgeDirected are fitted to,
+// and the largest difference between neighbours treated as smooth.
+const (
+	edgeRadius = 3
+	edgeSmooth = 8
+)
+
+func (EdgeDirected) Interpolate(img *Image) {
+	at := img.mirrorAt
+	for y := 0; y < img.Height; y++ {
+		for x := 1 - y%2; x < img.Width; x += 2 {
+			neighbors := img.neighbors(x, y)
+			min, max, _ := minmaxmedian(neighbors)
+			if int(max)-int(min) <= edgeSmooth {
+				img.Image[y*img.Width+x] = mean(neighbors)
+				continue
+			}
+
+			// Every known pixel in the window is predicted from the known pixels
+			// two apart in the same directions as the neighbours of (x, y).
+			// The least squares weights of these predictions are then applied
+			// to the neighbours of (x, y).
+			var a [4][4]float64
+			var b [4]float64
+			for v := y - edgeRadius; v <= y+edgeRadius; v++ {
+				u0 := x - edgeRadius
+				if (u0+v)&1 != 0 {
+					u0++
+				}
+				for u := u0; u <= x+edgeRadius; u += 2 {
+					c := [4]float64{
+						float64(at(u, v-2)),
+						float64(at(u+2, v)),
+						float64(at(u, v+2)),
+						float64(at(u-2, v)),
+					}
+					t := float64(at(u, v))
+					for i := range c {
+						for j := range c {
+							a[i][j] += c[i] * c[j]
+						}
+						b[i] += c[i] * t
+					}
+				}
+			}
+
+			w, ok := solve4(a, b)
+			if !ok {
+				img.Image[y*img.Width+x] = mean(neighbors)
+				continue
+			}
+			est := 0.0
+			for i := range w {
+				est += w[i] * float64(neighbors[i])
+			}
+			est = math.Max(float64(min), math.Min(float64(max), est))
+			img.Image[y*img.Width+x] = byte(est + 0.5)
+		}
+	}
+}
+
+// Solves a x = b with a small ridge for stability.
+// Returns false if a is too close to singular.
+func solve4(a [4][4]float64, b [4]float64) ([4]float64, bool) {
+	trace := a[0][0] + a[1][1] + a[2][2] + a[3][3]
+	if trace == 0 {
+		return [4]float64{}, false
+	}
+	for i := range a {
+		a[i][i] += 1e-6 * trace
+	}
+
+	// Gaussian elimination with partial pivoting.
+	for k := 0; k < 4; k++ {
+		p := k
+		for i := k + 1; i < 4; i++ {
+			if math.Abs(a[i][k]) > math.Abs(a[p][k]) {
+				p = i
+			}
+		}
+		if math.Abs(a[p][k]) < 1e-12*trace {
+			return [4]float64{}, false
+		}
+		a[k], a[p] = a[p], a[k]
+		b[k], b[p] = b[p], b[k]
+		for i := k + 1; i < 4; i++ {
+			f := a[i][k] / a[k][k]
+			for j := k; j < 4; j++ {
+				a[i][j] -= f * a[k][j]
+			}
+			b[i] -= f * b[k]
+		}
+	}
+
+	var x [4]float64
+	for k := 3; k >= 0; k-- {
+		sum := b[k]
+		for j := k + 1; j < 4; j++ {
+			sum -= a[k][j] * x[j]
+		}
+		x[k] = sum / a[k][k]
+	}
+	return x, true
+}
+
+// Returns the pixel (x, y) where coordinates outside of the image are mirrored
+// about the first and last pixel. Mirroring preserves the parity of x+y,
+// so the mirrored pixel is known whenever (x, y) would be.
+func (img *Image) mirrorAt(x, y int) byte {
+	return img.At(reflect(x, img.Width), reflect(y, img.Height))
+}
+
+func reflect(x, n int) int {
+	if x >= 0 && x < n {
+		return x
+	}
+	if n == 1 {
+		return 0
+	}
+	p := 2 * (n - 1)
+	x %= p
+	if x < 0 {
+		x += p
+	}
+	if x >= n {
+		x = p - x
+	}
+	return x
+}
+
+// Returns the pixel (x, y) where coordinates outside of the image are
+// treated according to border. Never called with BorderCAI3.
+func (img *Image) borderAt(x, y int, border Border) byte {
+	switch border {
+	case BorderReplicate:
+		cx, cy := clamp(x, 0, img.Width-1), clamp(y, 0, img.Height-1)
+		if (cx+cy)&1 != (x+y)&1 {
+			// The nearest pixel on the border is not known,
+			// step along the border to a known one.
+			if cx != x {
+				cy += stepInside(cy, img.Height)
+			} else {
+				cx += stepInside(cx, img.Width)
+			}
+		}
+		return img.At(cx, cy)
+	case BorderExtrapolate:
+		return byte(clamp(img.extrapolateAt(x, y), 0, 255))
+	}
+	return img.mirrorAt(x, y)
+}
+
+// Returns the direction along a line of length n from i towards the middle.
+func stepInside(i, n int) int {
+	if i > 0 {
+		return -1
+	}
+	if n > 1 {
+		return 1
+	}
+	return 0
+}
+
+// Linearly extrapolates the pixel (x, y) from the two nearest known pixels
+// in the same row, then the same column.
+// Falls back to mirroring if the image is too small.
+func (img *Image) extrapolateAt(x, y int) int {
+	extrapolate := func(i, n int, at func(int) int) int {
+		// i1 is the nearest coordinate inside with the same parity as i,
+		// and i2 the next one further inside.
+		i1, i2 := i&1, i&1+2
+		if i >= n {
+			i1 = n - 1 - (n-1-i)&1
+			i2 = i1 - 2
+		}
+		if i2 < 0 || i2 >= n {
+			return at(reflect(i, n))
+		}
+		v1, v2 := at(i1), at(i2)
+		d := (i - i1) / 2
+		if d < 0 {
+			d = -d
+		}
+		return v1 + d*(v1-v2)
+	}
+
+	if x < 0 || x >= img.Width {
+		return extrapolate(x, img.Width, func(x int) int {
+			return img.extrapolateAt(x, y)
+		})
+	}
+	if y < 0 || y >= img.Height {
+		return extrapolate(y, img.Height, func(y int) int {
+			return img.extrapolateAt(x, y)
+		})
+	}
+	return int(img.At(x, y))
+}
+
+// Returns the neighbours of pixel (x, y) clockwise, starting with the top pixel.
+// Neighbours outside of the image are mirrored.
+func (img *Image) neighbors(x, y int) [4]byte {
+	if x > 0 && y > 0 && x < img.Width-1 && y < img.Height-1 {
+		i := y*img.Width + x
+		return [4]byte{img.Image[i-img.Width], img.Image[i+1], img.Image[i+img.Width], img.Image[i-1]}
+	}
+	return [4]byte{img.mirrorAt(x, y-1), img.mirrorAt(x+1, y), img.mirrorAt(x, y+1), img.mirrorAt(x-1, y)}
+}
+
+// Candidates and window radius in blocks of the estimated cai thresholds.
+var thresholdCandidates = [...]byte{4, 8, 20, 40, 60}
+
+const thresholdRadius = 8
+
+// Buffers of estimateThresholds.
+type thresholdBuffers struct {
+	sums   []uint32 // last rows of the summed area tables of the prediction errors
+	least  []uint32 // least window error of each block in a row
+	chosen []byte   // threshold of each block
+}
+
+// Estimates the cai threshold of each block from the top left pixels,
+// which are the only pixels known exactly regardless of quantization.
+// Returns the threshold of the block (x, y).
+//
+// Every top left pixel off the border is predicted by cai from the four nearest
+// top left pixels with each candidate threshold, and a block takes the candidate
+// with the least squared error over the surrounding blocks, the smallest on ties.
+// Unlike a noise level, the error tells fine texture, which needs a low
+// threshold, from noise, which needs a high one.
+func estimateThresholds(img *Image, buf *thresholdBuffers) func(x, y int) int {
+	const n = len(thresholdCandidates)
+	bw := img.Width / 2
+	bh := img.Height / 2
+	if buf == nil {
+		buf = &thresholdBuffers{}
+	}
+
+	// sums keeps the rows of the windows being chosen from the summed area
+	// table of every candidate, with an extra leading row and column of zeros.
+	// It wraps around on large images, but the sums of windows still fit.
+	const rows = 2*thresholdRadius + 2
+	buf.sums = grow(buf.sums, rows*n*(bw+1))
+	buf.least = grow(buf.least, bw)
+	buf.chosen = grow(buf.chosen, bw*bh)
+	sums, least, chosen := buf.sums, buf.least, buf.chosen
+	row := func(k, y int) []uint32 {
+		i := ((y%rows)*n + k) * (bw + 1)
+		return sums[i : i+bw+1]
+	}
+
+	// Chooses the thresholds of the row y of blocks once its window is summed.
+	choose := func(y int) {
+		y0, y1 := clamp(y-thresholdRadius, 0, bh), clamp(y+thresholdRadius+1, 0, bh)
+		for k, threshold := range thresholdCandidates {
+			top, bottom := row(k, y0), row(k, y1)
+			for x := 0; x < bw; x++ {
+				x0, x1 := clamp(x-thresholdRadius, 0, bw), clamp(x+thresholdRadius+1, 0, bw)
+				sum := bottom[x1] - bottom[x0] - top[x1] + top[x0]
+				if k == 0 || sum < least[x] {
+					least[x] = sum
+					chosen[y*bw+x] = threshold
+				}
+			}
+		}
+	}
+
+	for k := range thresholdCandidates {
+		first := row(k, 0)
+		for x := range first {
+			first[x] = 0
+		}
+	}
+	for y := 0; y < bh; y++ {
+		var above, below [n][]uint32
+		var rowSums [n]uint32
+		for k := range thresholdCandidates {
+			above[k], below[k] = row(k, y), row(k, y+1)
+			below[k][0] = 0
+		}
+		for x := 0; x < bw; x++ {
+			if x > 0 && y > 0 && x < bw-1 && y < bh-1 {
+				i := 2*y*img.Width + 2*x
+				d := decideCAI([4]byte{img.Image[i-2*img.Width], img.Image[i+2], img.Image[i+2*img.Width], img.Image[i-2]})
+				for k, threshold := range thresholdCandidates {
+					e := uint32(absdiff(d.interpolate(int(threshold)), img.Image[i]))
+					rowSums[k] += e * e
+				}
+			}
+			for k := range thresholdCandidates {
+				below[k][x+1] = rowSums[k] + above[k][x+1]
+			}
+		}
+		if y >= thresholdRadius {
+			choose(y - thresholdRadius)
+		}
+	}
+	for y := clamp(bh-thresholdRadius, 0, bh); y < bh; y++ {
+		choose(y)
+	}
+
+	return func(x, y int) int {
+		return int(chosen[y*bw+x])
+	}
+}
+
+// Returns the mean of the neighbours rounded to nearest.
+func mean(neighbors [4]byte) byte {
+	sum := int(neighbors[0]) + int(neighbors[1]) + int(neighbors[2]) + int(neighbors[3])
+	return byte((sum + 2) / 4)
+}
+
+// Context Adaptive Interpolation.
+// Neighbors are ordered clockwise, starting with the top pixel
+func cai(neighbors [4]byte, threshold int) byte {
+	min, max, median := minmaxmedian(neighbors)
+
+	// returned values are all rounded to nearest
+	if int(max)-int(min) <= threshold {
+		return mean(neighbors)
+	}
+	if absdiff(neighbors[1], neighbors[3])-absdiff(neighbors[0], neighbors[2]) > threshold {
+		sum := int(neighbors[0]) + int(neighbors[2])
+		return byte((sum + 1) / 2)
+	}
+	if absdiff(neighbors[0], neighbors[2])-absdiff(neighbors[1], neighbors[3]) > threshold {
+		sum := int(neighbors[1]) + int(neighbors[3])
+		return byte((sum + 1) / 2)
+	}
+	return median
+}
+
+// The values cai chooses from for some neighbours, which only depend on
+// the threshold through comparisons. Lets the thresholds be tried without
+// sorting the neighbours every time, while cai itself avoids the extra work.
+type caiDecision struct {
+	spread int // largest minus smallest neighbour
+	across int // horizontal minus vertical difference
+
+	// returned values are all rounded to nearest
+	mean, vertical, horizontal, median byte
+}
+
+func decideCAI(neighbors [4]byte) caiDecision {
+	min, max, median := minmaxmedian(neighbors)
+	return caiDecision{
+		spread:     int(max) - int(min),
+		across:     absdiff(neighbors[1], neighbors[3]) - absdiff(neighbors[0], neighbors[2]),
+		mean:       mean(neighbors),
+		vertical:   byte((int(neighbors[0]) + int(neighbors[2]) + 1) / 2),
+		horizontal: byte((int(neighbors[1]) + int(neighbors[3]) + 1) / 2),
+		median:     median,
+	}
+}
+
+func (d *caiDecision) interpolate(threshold int) byte {
+	switch {
+	case d.spread <= threshold:
+		return d.mean
+	case d.across > threshold:
+		return d.vertical
+	case -d.across > threshold:
+		return d.horizontal
+	}
+	return d.median
+}
+
+func absdiff(x, y byte) int {
+	if x > y {
+		return int(x - y)
+	}
+	return int(y - x)
+}
+
+func clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+func minmaxmedian(p [4]byte) (byte, byte, byte) {
+	b := [4]byte{}
+
+	if p[0] < p[1] {
+		b[0], b[1] = p[0], p[1]
+	} else {
+		b[0], b[1] = p[1], p[0]
+	}
+	if p[2] < p[3] {
+		b[2], b[3] = p[2], p[3]
+	} else {
+		b[2], b[3] = p[3], p[2]
+	}
+
+	if b[0] > b[2] {
+		b[0], b[2] = b[2], b[0]
+	}
+	if b[1] > b[3] {
+		b[1], b[3] = b[3], b[1]
+	}
+	return b[0], b[3], b[1]
+}
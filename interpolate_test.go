@@ -0,0 +1,277 @@
+package gshe
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+var interpolators = map[string]Interpolator{
+	"cai":          CAI{},
+	"bilinear":     Bilinear{},
+	"bicubic":      Bicubic{},
+	"edgedirected": EdgeDirected{},
+}
+
+// Returns a copy of img with the pixels discarded by compression zeroed.
+func discarded(img *Image) *Image {
+	ret := *img
+	ret.Image = append([]byte(nil), img.Image...)
+	for y := 0; y < ret.Height; y++ {
+		for x := 1 - y%2; x < ret.Width; x += 2 {
+			ret.Image[y*ret.Width+x] = 0
+		}
+	}
+	return &ret
+}
+
+// Returns the sum of squared differences of the pixels of a and b.
+func sse(a, b *Image) int {
+	sum := 0
+	for i := range a.Image {
+		d := int(a.Image[i]) - int(b.Image[i])
+		sum += d * d
+	}
+	return sum
+}
+
+func TestInterpolateRamp(t *testing.T) {
+	// Every interpolator should reconstruct a linear ramp away from the border.
+	w, h := 16, 12
+	payload := make([]byte, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			payload[y*w+x] = byte(4*x + 3*y + 10)
+		}
+	}
+	img, err := NewImage(payload, w, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const border = 3
+	for name, interp := range interpolators {
+		got := discarded(img)
+		interp.Interpolate(got)
+		for y := border; y < h-border; y++ {
+			expect := img.Image[y*w+border : (y+1)*w-border]
+			row := got.Image[y*w+border : (y+1)*w-border]
+			if !bytes.Equal(row, expect) {
+				t.Errorf("%v row %v:\nexpect: %v\ngot:    %v", name, y, expect, row)
+			}
+		}
+	}
+}
+
+func TestEdgeDirectedDiagonalEdge(t *testing.T) {
+	// A diagonal edge is neither horizontal nor vertical,
+	// which EdgeDirected should follow better than Bilinear.
+	w, h := 32, 32
+	payload := make([]byte, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if 2*x > y+8 {
+				payload[y*w+x] = 200
+			} else {
+				payload[y*w+x] = 40
+			}
+		}
+	}
+	img, err := NewImage(payload, w, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bilinear := discarded(img)
+	Bilinear{}.Interpolate(bilinear)
+	edge := discarded(img)
+	EdgeDirected{}.Interpolate(edge)
+
+	if sse(edge, img) >= sse(bilinear, img) {
+		t.Fatalf("edge directed error %v not less than bilinear error %v", sse(edge, img), sse(bilinear, img))
+	}
+}
+
+type recordingInterpolator struct {
+	called *bool
+}
+
+func (r recordingInterpolator) Interpolate(img *Image) {
+	*r.called = true
+}
+
+func TestDecryptInterpolator(t *testing.T) {
+	key := []byte("I am probably a secretive secret")
+
+	img, err := NewImage(make([]byte, 8*6), 8, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := Encrypt(img, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp, err := Compress(enc, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	called := false
+	_, err = DecryptWithOptions(comp, key, &DecryptOptions{
+		Interpolator: recordingInterpolator{&called},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !called {
+		t.Fatal("interpolator not called")
+	}
+}
+
+// Returns an image of w x h with pixels f(x, y).
+func makeImage(t *testing.T, w, h int, f func(x, y int) int) *Image {
+	payload := make([]byte, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			payload[y*w+x] = byte(f(x, y))
+		}
+	}
+	img, err := NewImage(payload, w, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// Returns the first pixel on the edge rows and columns of got that differs from expect.
+func edgeMismatch(got, expect *Image) (int, int, bool) {
+	for y := 0; y < got.Height; y++ {
+		for x := 0; x < got.Width; x++ {
+			edge := x == 0 || y == 0 || x == got.Width-1 || y == got.Height-1
+			if edge && got.At(x, y) != expect.At(x, y) {
+				return x, y, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+func TestCAIBorderGradients(t *testing.T) {
+	// Gradients along and across the border are reconstructed on the edge rows and columns.
+	images := map[string]*Image{
+		"horizontal": makeImage(t, 16, 12, func(x, y int) int { return 15 * x }),
+		"vertical":   makeImage(t, 16, 12, func(x, y int) int { return 20 * y }),
+	}
+	// BorderMirror and BorderReplicate turn gradients across the border into false extrema.
+	borders := map[string]Border{
+		"cai3":        BorderCAI3,
+		"extrapolate": BorderExtrapolate,
+	}
+
+	for iname, img := range images {
+		for bname, border := range borders {
+			got := discarded(img)
+			CAI{Border: border}.Interpolate(got)
+			if border == BorderCAI3 {
+				// Two neighbours in the corners cannot tell the direction of a gradient.
+				w, h := img.Width, img.Height
+				for _, p := range [4]int{0, w - 1, (h - 1) * w, h*w - 1} {
+					got.Image[p] = img.Image[p]
+				}
+			}
+			if x, y, ok := edgeMismatch(got, img); ok {
+				t.Errorf("%v %v: pixel (%v, %v) expect %v got %v", iname, bname, x, y, img.At(x, y), got.At(x, y))
+			}
+		}
+	}
+}
+
+func TestCAIBorderExtrapolate(t *testing.T) {
+	// A ramp in both directions is reconstructed on the border by extrapolation.
+	img := makeImage(t, 16, 12, func(x, y int) int { return 4*x + 3*y + 10 })
+	got := discarded(img)
+	CAI{Border: BorderExtrapolate}.Interpolate(got)
+	if !bytes.Equal(got.Image, img.Image) {
+		t.Fatalf("\nexpect: %v\ngot:    %v", img.Image, got.Image)
+	}
+}
+
+func TestCAIBorderReplicateMirror(t *testing.T) {
+	// The threshold makes CAI take the mean of the neighbours everywhere,
+	// so the edge pixels tell which neighbours were substituted outside of the image.
+	known := []int{10, 50, 90, 130, 170, 210, 30, 250, 120, 200, 60, 140}
+	img := &Image{Image: make([]byte, 6*4), Width: 6, Height: 4}
+	for i, k := 0, 0; i < len(img.Image); i++ {
+		if (i%6+i/6)%2 == 0 {
+			img.Image[i] = byte(known[k])
+			k++
+		}
+	}
+
+	cases := []struct {
+		border Border
+		expect []byte
+	}{
+		{BorderMirror, []byte{
+			10, 80, 50, 120, 90, 150,
+			75, 130, 150, 170, 148, 210,
+			30, 153, 250, 150, 120, 148,
+			115, 200, 190, 60, 110, 140,
+		}},
+		{BorderReplicate, []byte{
+			10, 50, 50, 90, 90, 150,
+			45, 130, 150, 170, 148, 210,
+			30, 153, 250, 150, 120, 170,
+			115, 200, 178, 60, 95, 140,
+		}},
+	}
+	for _, c := range cases {
+		got := discarded(img)
+		CAI{Threshold: 255, Border: c.border}.Interpolate(got)
+		if !bytes.Equal(got.Image, c.expect) {
+			t.Fatalf("border %v\nexpect: %v\ngot:    %v", c.border, c.expect, got.Image)
+		}
+	}
+}
+
+func TestCAIDecision(t *testing.T) {
+	// The decision of cai gives the same pixel as cai for every threshold.
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		var neighbors [4]byte
+		for j := range neighbors {
+			neighbors[j] = byte(r.Intn(256))
+		}
+		d := decideCAI(neighbors)
+		for _, threshold := range []int{0, 4, 8, 20, 40, 60, 255} {
+			if got, expect := d.interpolate(threshold), cai(neighbors, threshold); got != expect {
+				t.Fatalf("neighbours %v threshold %v\nexpect: %v\ngot: %v", neighbors, threshold, expect, got)
+			}
+		}
+	}
+}
+
+func TestBorderAt(t *testing.T) {
+	img := makeImage(t, 6, 4, func(x, y int) int { return 10*y + x + 50 })
+	cases := []struct {
+		x, y   int
+		border Border
+		expect byte
+	}{
+		{-1, 1, BorderMirror, 61},
+		{6, 2, BorderMirror, 74},
+		{3, -1, BorderMirror, 63},
+		{-1, 1, BorderReplicate, 50},
+		{6, 2, BorderReplicate, 65},
+		{4, 4, BorderReplicate, 83},
+		{-1, 1, BorderExtrapolate, 59},
+		{6, 2, BorderExtrapolate, 76},
+		{1, -1, BorderExtrapolate, 41},
+		{-1, -1, BorderExtrapolate, 39},
+	}
+	for _, c := range cases {
+		if v := img.borderAt(c.x, c.y, c.border); v != c.expect {
+			t.Errorf("borderAt(%v, %v, %v): expect %v got %v", c.x, c.y, c.border, c.expect, v)
+		}
+	}
+}
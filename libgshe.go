@@ -2,6 +2,7 @@ package gshe
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"math/bits"
 	"math/rand"
@@ -20,8 +21,11 @@ type Image struct {
 // NewImage creates new image and possibly pads width and height
 // to a multiple of 2 with zeros.
 func NewImage(data []byte, width, height int) (*Image, error) {
+	if err := validateUnpadded(width, height); err != nil {
+		return nil, err
+	}
 	if len(data) != width*height {
-		return nil, errors.New("invalid image data")
+		return nil, fmt.Errorf("%w: %v bytes of data for %vx%v", ErrInvalidDimensions, len(data), width, height)
 	}
 
 	if width%2 == 0 && height%2 == 0 {
@@ -34,11 +38,9 @@ func NewImage(data []byte, width, height int) (*Image, error) {
 
 	pw := width + width%2
 	ph := height + height%2
-	padded := make([]byte, 0, pw*ph)
-	if width%2 != 0 {
-		for y := 0; y < height; y++ {
-			copy(padded[y*pw:], data[y*width:(y+1)*width])
-		}
+	padded := make([]byte, pw*ph)
+	for y := 0; y < height; y++ {
+		copy(padded[y*pw:], data[y*width:(y+1)*width])
 	}
 
 	return &Image{
@@ -56,38 +58,73 @@ func (img *Image) At(x, y int) byte {
 
 // source is a shim for math/rand.Source
 type source struct {
-	r io.Reader
+	r   io.Reader
+	buf [8]byte
 }
 
-func (src source) Int63() int64 {
-	buf := make([]byte, 8)
+func newSource(r io.Reader) *source {
+	return &source{r: r}
+}
+
+func (src *source) Int63() int64 {
+	buf := src.buf[:]
 	src.r.Read(buf)
 	return int64(buf[0]&0x7f)<<56 | int64(buf[1])<<48 | int64(buf[2])<<40 | int64(buf[3])<<32 |
 		int64(buf[4])<<24 | int64(buf[5])<<16 | int64(buf[6])<<8 | int64(buf[7])
 }
 
-func (src source) Seed(seed int64) {
+func (src *source) Seed(seed int64) {
 	return
 }
 
 // EncryptedImage represents an encrypted image.
-// Only half of the image is stored.
+// Only half of the image is stored, unless encrypted losslessly.
 type EncryptedImage struct {
 	Halfimage           []byte
 	Width, Height       int
 	PadWidth, PadHeight bool   // whether the image was padded
 	Salt                []byte // salt used in encryption
+	Antidiagonal        []byte // the other half of the image, only stored by EncryptLossless
+	KeyCheck            []byte // tells whether a key is the one used in encryption
 }
 
 // Encrypts the image img using a secret key.
 func Encrypt(img *Image, key []byte) (*EncryptedImage, error) {
+	return EncryptWithOptions(img, key, nil)
+}
+
+// Encrypts the image img using a secret key, keeping the entire image.
+// The result can be compressed either lossily with Compress
+// or losslessly with CompressLossless.
+func EncryptLossless(img *Image, key []byte) (*EncryptedImage, error) {
+	return EncryptWithOptions(img, key, &EncryptOptions{Lossless: true})
+}
+
+// Encrypts the image img using a secret key.
+// opts may be nil, which is the same as the zero EncryptOptions.
+func EncryptWithOptions(img *Image, key []byte, opts *EncryptOptions) (*EncryptedImage, error) {
+	ws := getWorkspace()
+	defer putWorkspace(ws)
+	dst := &EncryptedImage{}
+	if err := ws.EncryptInto(dst, img, key, opts); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+// Encrypts img into dst, reusing the buffers of dst.
+func (ws *Workspace) encrypt(dst *EncryptedImage, img *Image, key []byte, opts *EncryptOptions) error {
 	salt, err := genSalt()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	rng, check, err := newRNG(key, salt, opts.KDF)
+	if err != nil {
+		return err
 	}
-	rng := newRNG(key, salt)
 
-	mask := make([]byte, len(img.Image)/4)
+	ws.mask = grow(ws.mask, len(img.Image)/4)
+	mask := ws.mask
 	rng.Read(mask)
 	maskAt := func(x, y int) byte {
 		// int division by 2 is 3 instructions while uint is 1
@@ -100,7 +137,7 @@ func Encrypt(img *Image, key []byte) (*EncryptedImage, error) {
 	// 		halfimage[0] is pixel (0, 0)
 	// 		halfimage[1] is pixel (1, 1)
 	// 		halfimage[2] is pixel (2, 0)
-	halfimage := make([]byte, len(img.Image)/2)
+	halfimage := grow(dst.Halfimage, len(img.Image)/2)
 	halfimageAt := func(x, y int) *byte {
 		return &halfimage[int(uint(y)/2)*img.Width+x]
 	}
@@ -112,25 +149,75 @@ func Encrypt(img *Image, key []byte) (*EncryptedImage, error) {
 		}
 	}
 
-	permuteHalfimage(halfimage, rand.New(source{rng}))
+	if !opts.Lossless {
+		permuteHalfimage(halfimage, rand.New(newSource(rng)))
+		*dst = EncryptedImage{
+			Halfimage: halfimage,
+			Salt:      salt,
+			KeyCheck:  check,
+			Width:     img.Width,
+			Height:    img.Height,
+			PadWidth:  img.PadWidth,
+			PadHeight: img.PadHeight,
+		}
+		return nil
+	}
 
-	return &EncryptedImage{
-		Halfimage: halfimage,
-		Salt:      salt,
-		Width:     img.Width,
-		Height:    img.Height,
-		PadWidth:  img.PadHeight,
-		PadHeight: img.PadHeight,
-	}, nil
+	// antidiagonal is stored in block order like halfimage, i.e.
+	// 		antidiagonal[0] is pixel (1, 0)
+	// 		antidiagonal[1] is pixel (0, 1)
+	// 		antidiagonal[2] is pixel (3, 0)
+	// and is masked with the same mask as its block.
+	antidiagonal := grow(dst.Antidiagonal, len(halfimage))
+	for y := 0; y < img.Height; y += 2 {
+		for x := 0; x < img.Width; x += 2 {
+			i := int(uint(y)/2)*img.Width + x
+			antidiagonal[i] = img.At(x+1, y) + maskAt(x, y)
+			antidiagonal[i+1] = img.At(x, y+1) + maskAt(x, y)
+		}
+	}
+
+	// Both halves are permuted together so that the blocks stay intact.
+	// The permutation is identical to that of permuteHalfimage.
+	ws.halves = grow(ws.halves, 2*len(halfimage))
+	blocks := ws.halves
+	for i := 0; i < len(halfimage); i += 2 {
+		copy(blocks[2*i:], halfimage[i:i+2])
+		copy(blocks[2*i+2:], antidiagonal[i:i+2])
+	}
+	permuteBlocks(blocks, 4, rand.New(newSource(rng)))
+	for i := 0; i < len(halfimage); i += 2 {
+		copy(halfimage[i:i+2], blocks[2*i:])
+		copy(antidiagonal[i:i+2], blocks[2*i+2:])
+	}
+
+	*dst = EncryptedImage{
+		Halfimage:    halfimage,
+		Antidiagonal: antidiagonal,
+		Salt:         salt,
+		KeyCheck:     check,
+		Width:        img.Width,
+		Height:       img.Height,
+		PadWidth:     img.PadWidth,
+		PadHeight:    img.PadHeight,
+	}
+	return nil
 }
 
 // permutes the half image p consisting of the top left and bottom right pixels
 // of each 2x2 blocks with rng.
 func permuteHalfimage(p []byte, rng *rand.Rand) {
-	for ; len(p) > 0; p = p[2:] {
-		n := rng.Intn(len(p)/2) * 2
-		p[0], p[n] = p[n], p[0]
-		p[1], p[n+1] = p[n+1], p[1]
+	permuteBlocks(p, 2, rng)
+}
+
+// permutes p consisting of consecutive blocks of the given size with rng.
+// The permutation only depends on the number of blocks.
+func permuteBlocks(p []byte, size int, rng *rand.Rand) {
+	for ; len(p) > 0; p = p[size:] {
+		n := rng.Intn(len(p)/size) * size
+		for j := 0; j < size; j++ {
+			p[j], p[n+j] = p[n+j], p[j]
+		}
 	}
 }
 
@@ -141,7 +228,9 @@ type CompressedImage struct {
 	EncQdiffs           []byte // encoded quantized differences, i.e. indexes into Qtable
 	Salt                []byte // salt used in encryption
 	Width, Height       int
-	PadWidth, PadHeight bool // whether the image was padded
+	PadWidth, PadHeight bool   // whether the image was padded
+	EncResiduals        []byte // encoded differences of the other half, only present if compressed losslessly
+	KeyCheck            []byte // key check of the encrypted image
 }
 
 // Same as CompressedImage, but without encoding qdiffs.
@@ -152,12 +241,15 @@ type compressedImage struct {
 	Qdiffs              []byte // quantized differences, i.e. indexes into Qtable
 	Salt                []byte // salt used in encryption
 	Width, Height       int
-	PadWidth, PadHeight bool // whether the image was padded
+	PadWidth, PadHeight bool   // whether the image was padded
+	Residuals           []byte // differences of the other half, nil if lossy
+	KeyCheck            []byte // key check of the encrypted image
 }
 
-func makeQtable(distortions []int, quantization uint8) []byte {
+// Returns the quantization table in the buffer of qtable.
+func makeQtable(qtable []byte, distortions []int, quantization uint8) []byte {
 	logq := byte(bits.TrailingZeros8(quantization))
-	qtable := make([]byte, 256>>logq)
+	qtable = grow(qtable, 256>>logq)
 	for k := range qtable {
 		qtable[k] = byte(k) << logq
 		for j := byte(1); j < quantization; j++ {
@@ -171,23 +263,39 @@ func makeQtable(distortions []int, quantization uint8) []byte {
 
 // This is the entire compression except without fselib encoding.
 func compress(img *EncryptedImage, quantization uint8) (*compressedImage, error) {
+	comp := &compressedImage{}
+	if err := (&Workspace{}).compress(comp, img, quantization); err != nil {
+		return nil, err
+	}
+	return comp, nil
+}
+
+// Compresses img into dst without fselib encoding, reusing the buffers of dst
+// for the quarterimage and qtable, and those of ws for the rest.
+func (ws *Workspace) compress(dst *compressedImage, img *EncryptedImage, quantization uint8) error {
+	if bits.OnesCount8(quantization) != 1 {
+		return fmt.Errorf("%w: %v is not a power of 2", ErrQuantization, quantization)
+	}
+
 	// Quantization creates disproportionate distortions
 	// due to unsigned arithmetic overflowing 255 or underflowing 0.
 	// However, this cannot be solved because the pixel values are masked,
 	// and the unmasking may cause the overflow or underflow.
-	diffs := make([]byte, len(img.Halfimage)/2)
+	// The diffs are quantized in place into the qdiffs.
+	ws.qdiffs = grow(ws.qdiffs, len(img.Halfimage)/2)
+	qdiffs := ws.qdiffs
 	for i := 0; i < len(img.Halfimage); i += 2 {
-		diffs[i/2] = img.Halfimage[i+1] - img.Halfimage[i]
+		qdiffs[i/2] = img.Halfimage[i+1] - img.Halfimage[i]
 	}
 
-	if bits.OnesCount8(quantization) != 1 {
-		return nil, errors.New("quantization must be power of 2")
+	ws.distortions = grow(ws.distortions, 256)
+	distortions := ws.distortions
+	for i := range distortions {
+		distortions[i] = 0
 	}
-
-	distortions := make([]int, 256)
 	logq := bits.TrailingZeros8(quantization)
 	maskq := quantization - 1
-	for _, v := range diffs {
+	for _, v := range qdiffs {
 		k := v >> logq
 		i := k << logq
 		for j := byte(0); j < quantization; j++ {
@@ -196,106 +304,317 @@ func compress(img *EncryptedImage, quantization uint8) (*compressedImage, error)
 		}
 	}
 
-	qdiffs := make([]byte, len(diffs))
-	for i, v := range diffs {
-		k := v >> logq
-		qdiffs[i] = k
+	for i, v := range qdiffs {
+		qdiffs[i] = v >> logq
 	}
 
-	quarterimage := make([]byte, len(diffs))
+	quarterimage := grow(dst.Quarterimage, len(qdiffs))
 	for i := range quarterimage {
 		quarterimage[i] = img.Halfimage[2*i]
 	}
 
-	return &compressedImage{
+	*dst = compressedImage{
 		Quarterimage: quarterimage,
-		Qtable:       makeQtable(distortions, quantization),
+		Qtable:       makeQtable(dst.Qtable, distortions, quantization),
 		Qdiffs:       qdiffs,
 		Salt:         img.Salt,
+		KeyCheck:     img.KeyCheck,
 		Width:        img.Width,
 		Height:       img.Height,
-		PadWidth:     img.PadHeight,
+		PadWidth:     img.PadWidth,
 		PadHeight:    img.PadHeight,
-	}, nil
+	}
+	return nil
+}
+
+// This is the entire lossless compression except without fselib encoding.
+func compressLossless(img *EncryptedImage) (*compressedImage, error) {
+	comp := &compressedImage{}
+	if err := (&Workspace{}).compressLossless(comp, img); err != nil {
+		return nil, err
+	}
+	return comp, nil
+}
+
+// Compresses img losslessly into dst without fselib encoding, see Workspace.compress.
+func (ws *Workspace) compressLossless(dst *compressedImage, img *EncryptedImage) error {
+	if len(img.Antidiagonal) != len(img.Halfimage) {
+		return errors.New("image was not encrypted losslessly")
+	}
+
+	if err := ws.compress(dst, img, 1); err != nil {
+		return err
+	}
+
+	// The residuals are the differences of the top right and bottom left pixels
+	// from the top left pixel, which are masked identically like the diffs.
+	ws.residuals = grow(ws.residuals, len(img.Antidiagonal))
+	residuals := ws.residuals
+	for i := 0; i < len(img.Antidiagonal); i += 2 {
+		residuals[i] = img.Antidiagonal[i] - img.Halfimage[i]
+		residuals[i+1] = img.Antidiagonal[i+1] - img.Halfimage[i]
+	}
+	dst.Residuals = residuals
+	return nil
 }
 
 // Compresses an encrypted image with given quantization.
 // quantization must be a power of 2.
 func Compress(img *EncryptedImage, quantization uint8) (*CompressedImage, error) {
-	comp, err := compress(img, quantization)
-	if err != nil {
+	return CompressWithOptions(img, quantization, nil)
+}
+
+// Compresses an encrypted image without loss.
+// img must be encrypted with EncryptLossless.
+func CompressLossless(img *EncryptedImage) (*CompressedImage, error) {
+	return CompressWithOptions(img, 1, &CompressOptions{Lossless: true})
+}
+
+// Compresses an encrypted image with given quantization.
+// opts may be nil, which is the same as the zero CompressOptions.
+func CompressWithOptions(img *EncryptedImage, quantization uint8, opts *CompressOptions) (*CompressedImage, error) {
+	ws := getWorkspace()
+	defer putWorkspace(ws)
+	dst := &CompressedImage{}
+	if err := ws.CompressInto(dst, img, quantization, opts); err != nil {
 		return nil, err
 	}
+	return dst, nil
+}
 
-	encqdiffs := make([]byte, len(comp.Qdiffs))
+// Encodes the qdiffs and residuals of comp with fselib into dst, reusing the buffers of dst.
+// The sections not encoded are shared with comp.
+func encodeCompressed(dst *CompressedImage, comp *compressedImage) error {
+	encqdiffs := grow(dst.EncQdiffs, len(comp.Qdiffs))
 	n, err := fselib.Encode(encqdiffs, comp.Qdiffs)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return &CompressedImage{
+	var encresiduals []byte
+	if comp.Residuals != nil {
+		encresiduals = grow(dst.EncResiduals, len(comp.Residuals))
+		m, err := fselib.Encode(encresiduals, comp.Residuals)
+		if err != nil {
+			return err
+		}
+		encresiduals = encresiduals[:m]
+	}
+
+	*dst = CompressedImage{
 		Quarterimage: comp.Quarterimage,
 		Qtable:       comp.Qtable,
 		EncQdiffs:    encqdiffs[:n],
-		Salt:         img.Salt,
+		EncResiduals: encresiduals,
+		Salt:         comp.Salt,
+		KeyCheck:     comp.KeyCheck,
 		Width:        comp.Width,
 		Height:       comp.Height,
 		PadWidth:     comp.PadWidth,
 		PadHeight:    comp.PadHeight,
-	}, nil
+	}
+	return nil
+}
+
+// DecryptOptions configures the reconstruction of the pixels discarded by compression.
+// The zero value selects everything automatically.
+type DecryptOptions struct {
+	// Interpolator reconstructs the discarded pixels.
+	// If nil, CAI is used with Threshold and ThresholdMap.
+	Interpolator Interpolator
+
+	// Threshold of the default CAI interpolator, see CAI.
+	Threshold int
+
+	// ThresholdMap of the default CAI interpolator, see CAI.
+	ThresholdMap func(x, y int) int
+
+	// Border of the default CAI interpolator, see CAI.
+	Border Border
+
+	// Iterations of refining the quantized bottom right pixels.
+	// Each iteration estimates these pixels from their interpolated neighbours,
+	// constrains the estimates to their quantization bins, and interpolates again.
+	// Improves quality at coarse quantization, has no effect with quantization 1.
+	Iterations int
+
+	// KDF the image was encrypted with, PBKDF2 if nil.
+	KDF KDF
+}
+
+// Returns the interpolator of the options, where the default CAI keeps
+// the buffers of its thresholds in buf.
+func (opts *DecryptOptions) interpolator(buf *thresholdBuffers) Interpolator {
+	if opts.Interpolator != nil {
+		return opts.Interpolator
+	}
+	return CAI{
+		Threshold:    opts.Threshold,
+		ThresholdMap: opts.ThresholdMap,
+		Border:       opts.Border,
+		buf:          buf,
+	}
 }
 
 // Decrypts a compressed image with the same secret key used in encryption.
 func Decrypt(img *CompressedImage, key []byte) (*Image, error) {
-	qdiffs := make([]byte, len(img.Quarterimage))
-	n, err := fselib.Decode(qdiffs, img.EncQdiffs)
-	if err != nil {
+	return DecryptWithOptions(img, key, nil)
+}
+
+// Decrypts a compressed image with the same secret key used in encryption.
+// opts may be nil, which is the same as the zero DecryptOptions.
+func DecryptWithOptions(img *CompressedImage, key []byte, opts *DecryptOptions) (*Image, error) {
+	ws := getWorkspace()
+	defer putWorkspace(ws)
+	dst := &Image{}
+	if err := ws.DecryptInto(dst, img, key, opts); err != nil {
 		return nil, err
 	}
-	qdiffs = qdiffs[:n]
+	return dst, nil
+}
+
+// Validates img and decodes its qdiffs and residuals with fselib.
+func decodeCompressed(img *CompressedImage) (*compressedImage, error) {
+	comp := &compressedImage{}
+	if err := (&Workspace{}).decodeCompressed(comp, img); err != nil {
+		return nil, err
+	}
+	return comp, nil
+}
+
+// Validates img and decodes it into dst with the buffers of ws.
+// The sections not encoded are shared with img.
+func (ws *Workspace) decodeCompressed(dst *compressedImage, img *CompressedImage) error {
+	if err := img.Validate(); err != nil {
+		return err
+	}
+	qdiffs, err := img.decodeQdiffs(ws.qdiffs)
+	if err != nil {
+		return err
+	}
+	ws.qdiffs = qdiffs
+	if len(qdiffs) != len(img.Quarterimage) {
+		return corrupt("qdiffs", fmt.Errorf("%v qdiffs for %v blocks", len(qdiffs), len(img.Quarterimage)))
+	}
+	for _, v := range qdiffs {
+		if int(v) >= len(img.Qtable) {
+			return corrupt("qdiffs", fmt.Errorf("qdiff %v out of range of qtable", v))
+		}
+	}
 
-	return decrypt(&compressedImage{
+	var residuals []byte
+	if len(img.EncResiduals) > 0 {
+		ws.residuals = grow(ws.residuals, 2*len(img.Quarterimage))
+		residuals = ws.residuals
+		n, err := fselib.Decode(residuals, img.EncResiduals)
+		if err != nil {
+			return corrupt("residuals", err)
+		}
+		if n != len(residuals) {
+			return corrupt("residuals", fmt.Errorf("%v residuals for %v blocks", n, len(img.Quarterimage)))
+		}
+	}
+
+	*dst = compressedImage{
 		Quarterimage: img.Quarterimage,
 		Qtable:       img.Qtable,
 		Qdiffs:       qdiffs,
 		Salt:         img.Salt,
+		KeyCheck:     img.KeyCheck,
 		Width:        img.Width,
 		Height:       img.Height,
-		PadWidth:     img.PadHeight,
+		PadWidth:     img.PadWidth,
 		PadHeight:    img.PadHeight,
-	}, key)
+		Residuals:    residuals,
+	}
+	return nil
 }
 
 // This is the entire decryption except without fselib decoding.
-func decrypt(img *compressedImage, key []byte) (*Image, error) {
-	blocks := make([][4]byte, len(img.Quarterimage))
+func decrypt(img *compressedImage, key []byte, opts *DecryptOptions) (*Image, error) {
+	dst := &Image{}
+	if err := (&Workspace{}).decrypt(dst, img, key, opts); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
 
+// Decrypts img into dst, reusing the buffer of dst.
+func (ws *Workspace) decrypt(dst *Image, img *compressedImage, key []byte, opts *DecryptOptions) error {
+	if opts == nil {
+		opts = &DecryptOptions{}
+	}
+	ws.blocks = grow(ws.blocks, len(img.Quarterimage))
+	blocks := ws.blocks
 	for i := range blocks {
-		blocks[i][0] = img.Quarterimage[i]
-		blocks[i][3] = img.Quarterimage[i] + img.Qtable[img.Qdiffs[i]]
+		blocks[i] = img.block(i)
 	}
 
-	rng := newRNG(key, img.Salt)
+	rng, check, err := newRNG(key, img.Salt, opts.KDF)
+	if err != nil {
+		return err
+	}
+	if err := checkKey(img.KeyCheck, check); err != nil {
+		return err
+	}
 
-	mask := make([]byte, len(img.Quarterimage))
+	ws.mask = grow(ws.mask, len(img.Quarterimage))
+	mask := ws.mask
 	rng.Read(mask)
 
-	blocks = unpermuteBlocks(blocks, rand.New(source{rng}))
+	ws.indices = grow(ws.indices, len(blocks))
+	ws.unpermuted = grow(ws.unpermuted, len(blocks))
+	blocks = unpermuteBlocks(ws.unpermuted, blocks, ws.indices, rand.New(newSource(rng)))
+
+	ws.reconstruct(dst, img, blocks, mask, img.Width/2, img.Height/2, opts)
+	dst.PadWidth = img.PadWidth
+	dst.PadHeight = img.PadHeight
+	return nil
+}
+
+// Returns the permuted block i of img, which is still masked.
+func (img *compressedImage) block(i int) [4]byte {
+	var b [4]byte
+	b[0] = img.Quarterimage[i]
+	b[3] = img.Quarterimage[i] + img.Qtable[img.Qdiffs[i]]
+	if img.Residuals != nil {
+		b[1] = img.Quarterimage[i] + img.Residuals[2*i]
+		b[2] = img.Quarterimage[i] + img.Residuals[2*i+1]
+	} else {
+		// The quantization bin is carried through unpermuting
+		// in the top right pixel, which is interpolated later anyway.
+		b[1] = img.Qdiffs[i]
+	}
+	return b
+}
+
+// Unmasks the unpermuted blocks of bw x bh blocks and reconstructs the image into dst.
+// mask[i] is the mask of blocks[i].
+func (ws *Workspace) reconstruct(dst *Image, img *compressedImage, blocks [][4]byte, mask []byte, bw, bh int, opts *DecryptOptions) {
+	if opts == nil {
+		opts = &DecryptOptions{}
+	}
+
+	var bins []byte
+	if img.Residuals == nil {
+		ws.bins = grow(ws.bins, len(blocks))
+		bins = ws.bins
+		for i := range blocks {
+			bins[i] = blocks[i][1]
+		}
+	}
 
 	for i, v := range mask {
 		blocks[i][0] -= v
+		blocks[i][1] -= v
+		blocks[i][2] -= v
 		blocks[i][3] -= v
 	}
 
-	// TODO: compute threshold from image complexity
-	threshold := 20
-	bw := img.Width / 2
-	bh := img.Height / 2
-	interpolateBlocks(blocks, bw, bh, threshold)
-
-	image := make([]byte, len(img.Quarterimage)*4)
+	width := 2 * bw
+	image := grow(dst.Image, len(blocks)*4)
 	imageAt := func(x, y int) *byte {
-		return &image[y*img.Width+x]
+		return &image[y*width+x]
 	}
 	for y := 0; y < bh; y++ {
 		for x := 0; x < bw; x++ {
@@ -306,125 +625,111 @@ func decrypt(img *compressedImage, key []byte) (*Image, error) {
 		}
 	}
 
-	return &Image{
-		Image:     image,
-		Width:     img.Width,
-		Height:    img.Height,
-		PadWidth:  img.PadWidth,
-		PadHeight: img.PadHeight,
-	}, nil
-}
-
-// unpermute the 2x2 blocks according to rng, which must match the state used
-// in permuteHalfimage.
-// Does not modify blocks and returns the unpermuted blocks.
-func unpermuteBlocks(blocks [][4]byte, rng *rand.Rand) [][4]byte {
-	indices := make([]int, len(blocks))
-	for i := range indices {
-		indices[i] = i
-	}
-	for s := indices; len(s) > 0; s = s[1:] {
-		n := rng.Intn(len(s))
-		s[0], s[n] = s[n], s[0]
+	*dst = Image{
+		Image:  image,
+		Width:  width,
+		Height: 2 * bh,
 	}
+	if img.Residuals == nil {
+		interpolator := opts.interpolator(&ws.thresholds)
+		interpolator.Interpolate(dst)
 
-	ret := make([][4]byte, len(blocks))
-	for i, v := range indices {
-		ret[v] = blocks[i]
+		if opts.Iterations > 0 && len(img.Qtable) > 0 && len(img.Qtable) < 256 {
+			logq := bits.TrailingZeros(256 / uint(len(img.Qtable)))
+			ws.refined = grow(ws.refined, len(bins))
+			refine(dst, bins, ws.refined, logq, interpolator, opts.Iterations)
+		}
 	}
-	return ret
 }
 
-// Interpolates the blocks with cai.
-// Performs some heuristics along the border of the image.
-func interpolateBlocks(blocks [][4]byte, bw, bh, threshold int) {
-	for y := 0; y < bh; y++ {
-		for x := 0; x < bw; x++ {
-			i := y*bw + x
-			up := (y-1)*bw + x
-			right := y*bw + x + 1
-			down := (y+1)*bw + x
-			left := y*bw + x - 1
-
-			// On the image border, there are pixels without 4 neighbours.
-			// Leaving these neighbours as 0 creates undesirable artifacts.
-			// Here we heuristically choose values from the current block.
-			neighbors := [4]byte{0, 0, blocks[i][3], blocks[i][0]}
-			if y > 0 {
-				neighbors[0] = blocks[up][3]
-			} else {
-				neighbors[0] = blocks[i][3]
-			}
-			if x < bw-1 {
-				neighbors[1] = blocks[right][0]
-			} else {
-				neighbors[1] = blocks[i][0]
+// Refines the bottom right pixels of img quantized with 1<<logq, see DecryptOptions.Iterations.
+// bins are the quantized differences of the blocks, and refined is a buffer of the same length.
+func refine(img *Image, bins, refined []byte, logq int, interpolator Interpolator, iterations int) {
+	bw := img.Width / 2
+	bh := img.Height / 2
+	hi := byte(1)<<logq - 1
+	for ; iterations > 0; iterations-- {
+		for y := 0; y < bh; y++ {
+			for x := 0; x < bw; x++ {
+				i := y*bw + x
+				topleft := img.At(2*x, 2*y)
+				estimate := mean(img.neighbors(2*x+1, 2*y+1))
+
+				// The difference from the top left pixel must lie within the bin,
+				// otherwise take the nearest end of the bin modulo 256.
+				lo := bins[i] << logq
+				d := estimate - topleft - lo
+				if d > hi {
+					if d-hi < -d {
+						d = hi
+					} else {
+						d = 0
+					}
+				}
+				refined[i] = topleft + lo + d
 			}
-			blocks[i][1] = cai(neighbors, threshold)
+		}
 
-			neighbors = [4]byte{blocks[i][0], blocks[i][3]}
-			if y < bh-1 {
-				neighbors[2] = blocks[down][0]
-			} else {
-				neighbors[2] = blocks[i][0]
-			}
-			if x > 0 {
-				neighbors[3] = blocks[left][3]
-			} else {
-				neighbors[3] = blocks[i][3]
+		for y := 0; y < bh; y++ {
+			for x := 0; x < bw; x++ {
+				img.Image[(2*y+1)*img.Width+2*x+1] = refined[y*bw+x]
 			}
-			blocks[i][2] = cai(neighbors, threshold)
 		}
+		interpolator.Interpolate(img)
 	}
 }
 
-// Context Adaptive Interpolation.
-// Neighbors are ordered clockwise, starting with the top pixel
-func cai(neighbors [4]byte, threshold int) byte {
-	min, max, median := minmaxmedian(neighbors)
-
-	// returned values are all rounded to nearest
-	if int(max)-int(min) <= threshold {
-		sum := int(neighbors[0]) + int(neighbors[1]) + int(neighbors[2]) + int(neighbors[3])
-		return byte((sum + 2) / 4)
-	}
-	if absdiff(neighbors[1], neighbors[3])-absdiff(neighbors[0], neighbors[2]) > threshold {
-		sum := int(neighbors[0]) + int(neighbors[2])
-		return byte((sum + 1) / 2)
-	}
-	if absdiff(neighbors[0], neighbors[2])-absdiff(neighbors[1], neighbors[3]) > threshold {
-		sum := int(neighbors[1]) + int(neighbors[3])
-		return byte((sum + 1) / 2)
+// unpermute the 2x2 blocks according to rng, which must match the state used
+// in permuteHalfimage.
+// Does not modify blocks and returns the unpermuted blocks in dst.
+// dst and indices are buffers of the same length as blocks.
+func unpermuteBlocks(dst, blocks [][4]byte, indices []int, rng *rand.Rand) [][4]byte {
+	for i, v := range permutation(indices, rng) {
+		dst[v] = blocks[i]
 	}
-	return median
+	return dst
 }
 
-func absdiff(x, y byte) int {
-	if x > y {
-		return int(x - y)
+// Returns the permutation of len(indices) blocks done by permuteHalfimage with rng
+// in indices, where block i of the permuted image is block indices[i] of the original.
+func permutation(indices []int, rng *rand.Rand) []int {
+	for i := range indices {
+		indices[i] = i
 	}
-	return int(y - x)
+	for s := indices; len(s) > 0; s = s[1:] {
+		n := rng.Intn(len(s))
+		s[0], s[n] = s[n], s[0]
+	}
+	return indices
 }
 
-func minmaxmedian(p [4]byte) (byte, byte, byte) {
-	b := [4]byte{}
+// Decrypts only the top left pixel of every 2x2 block of a compressed image,
+// which is a preview at half the resolution.
+// This is much faster than Decrypt since nothing needs to be decoded or interpolated.
+func DecryptPreview(img *CompressedImage, key []byte) (*Image, error) {
+	return decryptPreview(img, key, nil)
+}
 
-	if p[0] < p[1] {
-		b[0], b[1] = p[0], p[1]
-	} else {
-		b[0], b[1] = p[1], p[0]
+func decryptPreview(img *CompressedImage, key []byte, kdf KDF) (*Image, error) {
+	if err := img.Validate(); err != nil {
+		return nil, err
 	}
-	if p[2] < p[3] {
-		b[2], b[3] = p[2], p[3]
-	} else {
-		b[2], b[3] = p[3], p[2]
+	rng, check, err := newRNG(key, img.Salt, kdf)
+	if err != nil {
+		return nil, err
 	}
-
-	if b[0] > b[2] {
-		b[0], b[2] = b[2], b[0]
+	if err := checkKey(img.KeyCheck, check); err != nil {
+		return nil, err
 	}
-	if b[1] > b[3] {
-		b[1], b[3] = b[3], b[1]
+
+	mask := make([]byte, len(img.Quarterimage))
+	rng.Read(mask)
+
+	preview := make([]byte, len(img.Quarterimage))
+	for i, v := range permutation(make([]int, len(preview)), rand.New(newSource(rng))) {
+		preview[v] = img.Quarterimage[i] - mask[v]
 	}
-	return b[0], b[3], b[1]
+
+	// The preview is padded again if its size is odd.
+	return NewImage(preview, img.Width/2, img.Height/2)
 }
@@ -2,6 +2,7 @@ package gshe
 
 import (
 	"bytes"
+	"math"
 	"math/rand"
 	"os"
 	"testing"
@@ -34,7 +35,11 @@ func TestPermute(t *testing.T) {
 
 	payload := "Do I look like half an image to you?"
 	halfimage := []byte(payload)
-	rng := rand.New(source{newRNG(key, salt)})
+	r, _, err := newRNG(key, salt, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(newSource(r))
 	permuteHalfimage(halfimage, rng)
 
 	blocks := make([][4]byte, len(halfimage)/2)
@@ -42,8 +47,12 @@ func TestPermute(t *testing.T) {
 		blocks[i][0] = halfimage[2*i]
 		blocks[i][1] = halfimage[2*i+1]
 	}
-	rng = rand.New(source{newRNG(key, salt)})
-	blocks = unpermuteBlocks(blocks, rng)
+	r, _, err = newRNG(key, salt, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng = rand.New(newSource(r))
+	blocks = unpermuteBlocks(make([][4]byte, len(blocks)), blocks, make([]int, len(blocks)), rng)
 
 	got := make([]byte, len(halfimage))
 	for i := range blocks {
@@ -140,7 +149,7 @@ func TestDecryptHalfimage(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	dec, err := decrypt(comp, key)
+	dec, err := decrypt(comp, key, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -183,7 +192,7 @@ func TestDecryptGradient(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	dec, err := decrypt(comp, key)
+	dec, err := decrypt(comp, key, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -235,6 +244,296 @@ func TestFullDecryptGradient(t *testing.T) {
 	}
 }
 
+func TestEncryptLosslessHalfimage(t *testing.T) {
+	key := []byte("I am probably a secretive secret")
+	// The half image must not depend on whether the other half is kept.
+	payload := "Do I look like a real image to you??"
+	img, err := NewImage([]byte(payload), 6, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := EncryptLossless(img, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []byte{38, 38, 52, 68, 154, 144, 96, 43, 161, 238, 157, 181, 107, 150, 223, 40, 236, 236}
+	if !bytes.Equal(enc.Halfimage, expect) {
+		t.Fatalf("\nexpect: %v\ngot: %v", expect, enc.Halfimage)
+	}
+}
+
+func TestDecryptLossless(t *testing.T) {
+	key := []byte("I am probably a secretive secret")
+
+	payload := make([]byte, 15*9)
+	rand.New(rand.NewSource(1)).Read(payload)
+	img, err := NewImage(payload, 15, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := EncryptLossless(img, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp, err := CompressLossless(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := Decrypt(comp, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dec.Width != img.Width || dec.Height != img.Height ||
+		dec.PadWidth != img.PadWidth || dec.PadHeight != img.PadHeight {
+		t.Fatalf("\nexpect: %vx%v %v %v\ngot:    %vx%v %v %v",
+			img.Width, img.Height, img.PadWidth, img.PadHeight,
+			dec.Width, dec.Height, dec.PadWidth, dec.PadHeight)
+	}
+	if !bytes.Equal(dec.Image, img.Image) {
+		t.Fatalf("\nexpect: %v\ngot:    %v", img.Image, dec.Image)
+	}
+}
+
+func TestCompressLossyImageLosslessly(t *testing.T) {
+	key := []byte("I am probably a secretive secret")
+
+	img, err := NewImage(make([]byte, 16), 4, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := Encrypt(img, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CompressLossless(enc); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestEstimateThresholds(t *testing.T) {
+	bw, bh := 32, 8
+	img := &Image{Image: make([]byte, 4*bw*bh), Width: 2 * bw, Height: 2 * bh}
+	smallest := int(thresholdCandidates[0])
+	threshold := estimateThresholds(img, nil)
+	for y := 0; y < bh; y++ {
+		for x := 0; x < bw; x++ {
+			if v := threshold(x, y); v != smallest {
+				t.Fatalf("flat image threshold at (%v, %v): expect %v got %v", x, y, smallest, v)
+			}
+		}
+	}
+
+	// Fine texture on the left lowers the threshold, noise on the right does not.
+	r := rand.New(rand.NewSource(1))
+	for y := 0; y < img.Height; y++ {
+		for x := 0; x < img.Width; x++ {
+			v := 128 + 24*r.NormFloat64()
+			if x < img.Width/2 {
+				v = 128 + 100*math.Sin(float64(x+2*y)/2.5)
+			}
+			img.Image[y*img.Width+x] = byte(clamp(int(v), 0, 255))
+		}
+	}
+	threshold = estimateThresholds(img, nil)
+	texture, noise := threshold(0, 0), threshold(bw-1, bh-1)
+	t.Logf("texture threshold: %v noise threshold: %v", texture, noise)
+	if texture >= 20 || noise <= 20 {
+		t.Fatalf("expect texture < 20 < noise\ngot: %v %v", texture, noise)
+	}
+}
+
+// Returns the PSNR of b against a in dB.
+func psnr(a, b *Image) float64 {
+	mse := float64(sse(a, b)) / float64(len(a.Image))
+	return 10 * math.Log10(255*255/mse)
+}
+
+// Compares the PSNR of decryption with the fixed threshold 20 the package had before
+// and with estimated thresholds, on reproducible 128x128 images.
+// Only the sign of the gain is checked, not its amount.
+func TestThresholdPSNR(t *testing.T) {
+	key := []byte("I am probably a secretive secret")
+	cases := []struct {
+		name  string
+		pixel func(x, y int, r *rand.Rand) float64
+		gains bool // whether the estimate is better, otherwise it is no worse
+	}{
+		{"smooth", func(x, y int, r *rand.Rand) float64 {
+			return 40 + float64(x+y) + 2*r.NormFloat64()
+		}, false},
+		{"noisy", func(x, y int, r *rand.Rand) float64 {
+			return 40 + float64(x+y) + 12*r.NormFloat64()
+		}, true},
+		{"edges", func(x, y int, r *rand.Rand) float64 {
+			v := 60.0
+			if (x/24+y/24)%2 == 0 {
+				v = 180
+			}
+			return v + 3*r.NormFloat64()
+		}, true},
+		{"mixed", func(x, y int, r *rand.Rand) float64 {
+			v := 50 + float64(y)
+			if x > 64 {
+				v += 15 * r.NormFloat64()
+			}
+			if y > 40 && y < 90 && x > 30 {
+				v += 90
+			}
+			return v
+		}, true},
+		{"zoneplate", func(x, y int, r *rand.Rand) float64 {
+			dx, dy := float64(x-64), float64(y-64)
+			return 128 + 100*math.Cos((dx*dx+dy*dy)/180)
+		}, true},
+		{"stripes", func(x, y int, r *rand.Rand) float64 {
+			return 128 + 50*math.Sin(float64(x+2*y)/2.5)
+		}, true},
+	}
+
+	for _, c := range cases {
+		r := rand.New(rand.NewSource(1))
+		img := makeImage(t, 128, 128, func(x, y int) int {
+			return clamp(int(math.Round(c.pixel(x, y, r))), 0, 255)
+		})
+		enc, err := Encrypt(img, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, q := range []uint8{1, 4, 16} {
+			comp, err := Compress(enc, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fixed, err := DecryptWithOptions(comp, key, &DecryptOptions{Threshold: 20})
+			if err != nil {
+				t.Fatal(err)
+			}
+			est, err := Decrypt(comp, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotFixed, gotEst := psnr(img, fixed), psnr(img, est)
+			t.Logf("%-10v q%-2v threshold 20: %.2f dB estimated: %.2f dB gain: %+.2f dB", c.name, q, gotFixed, gotEst, gotEst-gotFixed)
+			if gotEst < gotFixed || c.gains && gotEst == gotFixed {
+				t.Errorf("%v q%v gains\nexpect: %v\ngot: %+.4f dB", c.name, q, c.gains, gotEst-gotFixed)
+			}
+		}
+	}
+}
+
+func TestDecryptThresholdMap(t *testing.T) {
+	key := []byte("I am probably a secretive secret")
+
+	img, err := NewImage(make([]byte, 8*6), 8, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := Encrypt(img, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp, err := Compress(enc, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[[2]int]bool{}
+	_, err = DecryptWithOptions(comp, key, &DecryptOptions{
+		ThresholdMap: func(x, y int) int {
+			seen[[2]int{x, y}] = true
+			return 20
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < 6; y += 2 {
+		for x := 0; x < 8; x += 2 {
+			if !seen[[2]int{x, y}] {
+				t.Fatalf("threshold of block (%v, %v) not queried", x, y)
+			}
+		}
+	}
+	if len(seen) != 12 {
+		t.Fatalf("expect 12 blocks queried, got %v", len(seen))
+	}
+}
+
+func TestDecryptIterations(t *testing.T) {
+	key := []byte("I am probably a secretive secret")
+	// Refinement should reduce the error of a smooth image at coarse quantization.
+	w, h := 64, 64
+	payload := make([]byte, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			payload[y*w+x] = byte(128 + 60*math.Sin(float64(x)/7)*math.Cos(float64(y)/11))
+		}
+	}
+	img, err := NewImage(payload, w, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := Encrypt(img, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp, err := Compress(enc, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sses := make([]int, 3)
+	for i, iterations := range []int{0, 1, 4} {
+		dec, err := DecryptWithOptions(comp, key, &DecryptOptions{Iterations: iterations})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sses[i] = sse(dec, img)
+	}
+	if sses[1] >= sses[0] || sses[2] > sses[1] {
+		t.Fatalf("squared errors with 0, 1, 4 iterations: %v", sses)
+	}
+}
+
+func TestDecryptPreview(t *testing.T) {
+	key := []byte("I am probably a secretive secret")
+
+	payload := make([]byte, 10*6)
+	rand.New(rand.NewSource(1)).Read(payload)
+	img, err := NewImage(payload, 10, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := Encrypt(img, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp, err := Compress(enc, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	preview, err := DecryptPreview(comp, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The preview is the top left pixels, padded to 6x4.
+	if preview.Width != 6 || preview.Height != 4 || !preview.PadWidth || !preview.PadHeight {
+		t.Fatalf("unexpected preview size %vx%v padded %v %v",
+			preview.Width, preview.Height, preview.PadWidth, preview.PadHeight)
+	}
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 5; x++ {
+			if preview.At(x, y) != img.At(2*x, 2*y) {
+				t.Fatalf("pixel (%v, %v): expect %v got %v", x, y, img.At(2*x, 2*y), preview.At(x, y))
+			}
+		}
+	}
+}
+
 // Collects elements from p each seperated by a distance specified by strides.
 // The last element from strides is not collected.
 // This repeats until end of p is reached.
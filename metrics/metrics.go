@@ -0,0 +1,288 @@
+// Package metrics measures the distortion between two greyscale images.
+//
+// Padding of the images is ignored, only the pixels of the original
+// unpadded image are compared.
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+
+	"github.com/Sinacam/gshe"
+)
+
+// Metrics holds every metric between two images.
+type Metrics struct {
+	MSE    float64 `json:"mse"`
+	PSNR   float64 `json:"psnr"`
+	SSIM   float64 `json:"ssim"`
+	MSSSIM float64 `json:"ms_ssim"`
+}
+
+// MarshalJSON encodes an infinite PSNR as null, which JSON has no number for.
+func (m Metrics) MarshalJSON() ([]byte, error) {
+	v := struct {
+		MSE    float64  `json:"mse"`
+		PSNR   *float64 `json:"psnr"`
+		SSIM   float64  `json:"ssim"`
+		MSSSIM float64  `json:"ms_ssim"`
+	}{MSE: m.MSE, SSIM: m.SSIM, MSSSIM: m.MSSSIM}
+	if !math.IsInf(m.PSNR, 0) {
+		v.PSNR = &m.PSNR
+	}
+	return json.Marshal(v)
+}
+
+// Compute returns every metric between a and b.
+func Compute(a, b *gshe.Image) (*Metrics, error) {
+	pa, pb, err := planes(a, b)
+	if err != nil {
+		return nil, err
+	}
+	mse := mse(pa, pb)
+	return &Metrics{
+		MSE:    mse,
+		PSNR:   psnr(mse),
+		SSIM:   ssim(pa, pb),
+		MSSSIM: msssim(pa, pb),
+	}, nil
+}
+
+// MSE returns the mean squared error between a and b.
+func MSE(a, b *gshe.Image) (float64, error) {
+	pa, pb, err := planes(a, b)
+	if err != nil {
+		return 0, err
+	}
+	return mse(pa, pb), nil
+}
+
+// PSNR returns the peak signal to noise ratio between a and b in decibels.
+// Identical images have infinite PSNR.
+func PSNR(a, b *gshe.Image) (float64, error) {
+	pa, pb, err := planes(a, b)
+	if err != nil {
+		return 0, err
+	}
+	return psnr(mse(pa, pb)), nil
+}
+
+// SSIM returns the mean structural similarity index between a and b,
+// with an 11x11 gaussian window of standard deviation 1.5.
+// The window is shrunk for images smaller than it.
+func SSIM(a, b *gshe.Image) (float64, error) {
+	pa, pb, err := planes(a, b)
+	if err != nil {
+		return 0, err
+	}
+	return ssim(pa, pb), nil
+}
+
+// MSSSIM returns the multi-scale structural similarity index between a and b
+// over 5 scales. Fewer scales are used for images too small to be halved
+// 4 times, with the weights of the remaining scales renormalized.
+func MSSSIM(a, b *gshe.Image) (float64, error) {
+	pa, pb, err := planes(a, b)
+	if err != nil {
+		return 0, err
+	}
+	return msssim(pa, pb), nil
+}
+
+// plane is an unpadded image with float pixels.
+type plane struct {
+	pix  []float64
+	w, h int
+}
+
+func (p *plane) at(x, y int) float64 {
+	return p.pix[y*p.w+x]
+}
+
+// Returns the unpadded planes of a and b, which must be of the same size.
+func planes(a, b *gshe.Image) (*plane, *plane, error) {
+	if a.Width != b.Width || a.Height != b.Height || a.PadWidth != b.PadWidth || a.PadHeight != b.PadHeight {
+		return nil, nil, errors.New("images differ in size")
+	}
+	return newPlane(a), newPlane(b), nil
+}
+
+func newPlane(img *gshe.Image) *plane {
+	w, h := img.Width, img.Height
+	if img.PadWidth {
+		w--
+	}
+	if img.PadHeight {
+		h--
+	}
+	p := &plane{pix: make([]float64, 0, w*h), w: w, h: h}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p.pix = append(p.pix, float64(img.At(x, y)))
+		}
+	}
+	return p
+}
+
+func mse(a, b *plane) float64 {
+	if len(a.pix) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for i := range a.pix {
+		d := a.pix[i] - b.pix[i]
+		sum += d * d
+	}
+	return sum / float64(len(a.pix))
+}
+
+func psnr(mse float64) float64 {
+	if mse == 0 {
+		return math.Inf(1)
+	}
+	return 10 * math.Log10(255*255/mse)
+}
+
+// Constants of SSIM for 8 bit pixels.
+const (
+	c1 = (0.01 * 255) * (0.01 * 255)
+	c2 = (0.03 * 255) * (0.03 * 255)
+
+	windowSize  = 11
+	windowSigma = 1.5
+)
+
+var msssimWeights = []float64{0.0448, 0.2856, 0.3001, 0.2363, 0.1333}
+
+func ssim(a, b *plane) float64 {
+	l, cs := ssimComponents(a, b)
+	return l * cs
+}
+
+func msssim(a, b *plane) float64 {
+	weights := msssimWeights
+	// Every scale must be at least 2 pixels in each dimension.
+	scales := 1
+	for w, h := a.w, a.h; scales < len(weights) && w >= 4 && h >= 4; w, h = w/2, h/2 {
+		scales++
+	}
+	weights = weights[:scales]
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+
+	result := 1.0
+	for i, w := range weights {
+		l, cs := ssimComponents(a, b)
+		if i == len(weights)-1 {
+			cs *= l
+		}
+		// Negative similarities are treated as none to keep the power real.
+		result *= math.Pow(math.Max(cs, 0), w/total)
+		a, b = downsample(a), downsample(b)
+	}
+	return result
+}
+
+// Returns the mean luminance and the mean contrast-structure term of SSIM,
+// whose product is SSIM.
+// The means are over every position of the window inside the image.
+func ssimComponents(a, b *plane) (float64, float64) {
+	if len(a.pix) == 0 {
+		return 1, 1
+	}
+
+	window := gaussian(windowSize, windowSigma, a.w, a.h)
+	ma := filter(a, window)
+	mb := filter(b, window)
+	saa := filter(product(a, a), window)
+	sbb := filter(product(b, b), window)
+	sab := filter(product(a, b), window)
+
+	lsum, cssum := 0.0, 0.0
+	for i := range ma.pix {
+		mua, mub := ma.pix[i], mb.pix[i]
+		va := saa.pix[i] - mua*mua
+		vb := sbb.pix[i] - mub*mub
+		cov := sab.pix[i] - mua*mub
+		lsum += (2*mua*mub + c1) / (mua*mua + mub*mub + c1)
+		cssum += (2*cov + c2) / (va + vb + c2)
+	}
+	n := float64(len(ma.pix))
+	return lsum / n, cssum / n
+}
+
+// Returns a normalized 1D gaussian window of the given size,
+// shrunk to an odd size that fits in w x h.
+func gaussian(size int, sigma float64, w, h int) []float64 {
+	for size > w || size > h {
+		size -= 2
+	}
+	if size < 1 {
+		size = 1
+	}
+
+	window := make([]float64, size)
+	sum := 0.0
+	for i := range window {
+		d := float64(i - size/2)
+		window[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		sum += window[i]
+	}
+	for i := range window {
+		window[i] /= sum
+	}
+	return window
+}
+
+// Filters p with the separable window, keeping only positions
+// where the window lies entirely inside p.
+func filter(p *plane, window []float64) *plane {
+	n := len(window)
+	w, h := p.w-n+1, p.h-n+1
+
+	rows := &plane{pix: make([]float64, w*p.h), w: w, h: p.h}
+	for y := 0; y < p.h; y++ {
+		for x := 0; x < w; x++ {
+			sum := 0.0
+			for k, v := range window {
+				sum += v * p.at(x+k, y)
+			}
+			rows.pix[y*w+x] = sum
+		}
+	}
+
+	ret := &plane{pix: make([]float64, w*h), w: w, h: h}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			sum := 0.0
+			for k, v := range window {
+				sum += v * rows.at(x, y+k)
+			}
+			ret.pix[y*w+x] = sum
+		}
+	}
+	return ret
+}
+
+func product(a, b *plane) *plane {
+	ret := &plane{pix: make([]float64, len(a.pix)), w: a.w, h: a.h}
+	for i := range a.pix {
+		ret.pix[i] = a.pix[i] * b.pix[i]
+	}
+	return ret
+}
+
+// Halves p by averaging 2x2 blocks, dropping an odd last row or column.
+func downsample(p *plane) *plane {
+	w, h := p.w/2, p.h/2
+	ret := &plane{pix: make([]float64, w*h), w: w, h: h}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			ret.pix[y*w+x] = (p.at(2*x, 2*y) + p.at(2*x+1, 2*y) + p.at(2*x, 2*y+1) + p.at(2*x+1, 2*y+1)) / 4
+		}
+	}
+	return ret
+}
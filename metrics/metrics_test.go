@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/Sinacam/gshe"
+)
+
+func newImage(t *testing.T, w, h int, f func(x, y int) byte) *gshe.Image {
+	data := make([]byte, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			data[y*w+x] = f(x, y)
+		}
+	}
+	img, err := gshe.NewImage(data, w, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func smooth(x, y int) byte {
+	return byte(128 + 100*math.Sin(float64(x)/5)*math.Cos(float64(y)/7))
+}
+
+func TestIdentical(t *testing.T) {
+	img := newImage(t, 64, 48, smooth)
+	m, err := Compute(img, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.MSE != 0 || !math.IsInf(m.PSNR, 1) || math.Abs(m.SSIM-1) > 1e-9 || math.Abs(m.MSSSIM-1) > 1e-9 {
+		t.Fatalf("unexpected metrics of identical images: %+v", m)
+	}
+}
+
+func TestMSE(t *testing.T) {
+	a := newImage(t, 4, 4, func(x, y int) byte { return 10 })
+	b := newImage(t, 4, 4, func(x, y int) byte {
+		if x == 0 {
+			return 14
+		}
+		return 10
+	})
+	mse, err := MSE(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mse != 4 {
+		t.Fatalf("expect 4 got %v", mse)
+	}
+	psnr, err := PSNR(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := 10 * math.Log10(255*255/4.0); math.Abs(psnr-expect) > 1e-9 {
+		t.Fatalf("expect %v got %v", expect, psnr)
+	}
+}
+
+func TestPadding(t *testing.T) {
+	// Differences in the padding are ignored.
+	a := newImage(t, 5, 3, smooth)
+	b := newImage(t, 5, 3, smooth)
+	for x := 0; x < b.Width; x++ {
+		b.Image[(b.Height-1)*b.Width+x] = 255
+	}
+	for y := 0; y < b.Height; y++ {
+		b.Image[y*b.Width+b.Width-1] = 255
+	}
+	m, err := Compute(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.MSE != 0 || math.Abs(m.SSIM-1) > 1e-9 {
+		t.Fatalf("padding was compared: %+v", m)
+	}
+}
+
+func TestNoiseLowersSimilarity(t *testing.T) {
+	img := newImage(t, 128, 128, smooth)
+	r := rand.New(rand.NewSource(1))
+	noisy := func(amplitude int) *gshe.Image {
+		return newImage(t, 128, 128, func(x, y int) byte {
+			return byte(int(smooth(x, y)) + r.Intn(2*amplitude+1) - amplitude)
+		})
+	}
+
+	prev := &Metrics{PSNR: math.Inf(1), SSIM: 1, MSSSIM: 1}
+	for _, amplitude := range []int{2, 8, 24} {
+		m, err := Compute(img, noisy(amplitude))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.PSNR >= prev.PSNR || m.SSIM >= prev.SSIM || m.MSSSIM >= prev.MSSSIM {
+			t.Fatalf("noise amplitude %v did not lower similarity: %+v then %+v", amplitude, prev, m)
+		}
+		prev = m
+	}
+}
+
+func TestSizeMismatch(t *testing.T) {
+	a := newImage(t, 4, 4, smooth)
+	b := newImage(t, 4, 6, smooth)
+	if _, err := Compute(a, b); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	b, err := json.Marshal(Metrics{MSE: 0, PSNR: math.Inf(1), SSIM: 1, MSSSIM: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := `{"mse":0,"psnr":null,"ssim":1,"ms_ssim":1}`; string(b) != expect {
+		t.Fatalf("\nexpect: %v\ngot: %v", expect, string(b))
+	}
+}
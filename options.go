@@ -0,0 +1,87 @@
+package gshe
+
+import "image"
+
+// Encryptor encrypts images, such as EncryptOptions.
+type Encryptor interface {
+	Encrypt(img *Image, key []byte) (*EncryptedImage, error)
+}
+
+// Compressor compresses encrypted images without the key,
+// such as CompressOptions or a remote service.
+type Compressor interface {
+	Compress(img *EncryptedImage, quantization uint8) (*CompressedImage, error)
+	CompressLossless(img *EncryptedImage) (*CompressedImage, error)
+}
+
+// Decryptor decrypts compressed images, such as DecryptOptions.
+type Decryptor interface {
+	Decrypt(img *CompressedImage, key []byte) (*Image, error)
+}
+
+// The option structs implement the interfaces. New settings are added to them
+// with zero values that behave as before, so that existing callers are unaffected.
+var (
+	_ Encryptor  = (*EncryptOptions)(nil)
+	_ Compressor = (*CompressOptions)(nil)
+	_ Decryptor  = (*DecryptOptions)(nil)
+)
+
+// EncryptOptions configures encryption, see EncryptWithOptions.
+// The zero value is the same as Encrypt.
+type EncryptOptions struct {
+	// Lossless keeps the entire image, see EncryptLossless.
+	Lossless bool
+
+	// KDF derives the keystream from the key, PBKDF2 if nil.
+	// The image must be decrypted with the same KDF.
+	KDF KDF
+}
+
+// Encrypt is the same as EncryptWithOptions with opts, which may be nil.
+func (opts *EncryptOptions) Encrypt(img *Image, key []byte) (*EncryptedImage, error) {
+	return EncryptWithOptions(img, key, opts)
+}
+
+// CompressOptions configures compression, see CompressWithOptions.
+// The zero value is the same as Compress.
+type CompressOptions struct {
+	// Lossless compresses without loss, see CompressLossless.
+	// The quantization must be 1.
+	Lossless bool
+}
+
+// Compress is the same as CompressWithOptions with opts, which may be nil.
+func (opts *CompressOptions) Compress(img *EncryptedImage, quantization uint8) (*CompressedImage, error) {
+	return CompressWithOptions(img, quantization, opts)
+}
+
+// CompressLossless is the same as CompressWithOptions with opts
+// and quantization 1, but always lossless.
+func (opts *CompressOptions) CompressLossless(img *EncryptedImage) (*CompressedImage, error) {
+	lossless := CompressOptions{}
+	if opts != nil {
+		lossless = *opts
+	}
+	lossless.Lossless = true
+	return CompressWithOptions(img, 1, &lossless)
+}
+
+// Decrypt is the same as DecryptWithOptions with opts, which may be nil.
+func (opts *DecryptOptions) Decrypt(img *CompressedImage, key []byte) (*Image, error) {
+	return DecryptWithOptions(img, key, opts)
+}
+
+// DecryptRegion is the same as DecryptRegionWithOptions with opts, which may be nil.
+func (opts *DecryptOptions) DecryptRegion(img *CompressedImage, key []byte, r image.Rectangle) (*Image, error) {
+	return DecryptRegionWithOptions(img, key, r, opts)
+}
+
+// DecryptPreview is the same as the function DecryptPreview but with the KDF of opts,
+// the other options do not apply to previews.
+func (opts *DecryptOptions) DecryptPreview(img *CompressedImage, key []byte) (*Image, error) {
+	if opts == nil {
+		return DecryptPreview(img, key)
+	}
+	return decryptPreview(img, key, opts.KDF)
+}
@@ -0,0 +1,145 @@
+package gshe
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"image"
+	"math/rand"
+	"testing"
+)
+
+func TestEncryptOptions(t *testing.T) {
+	key := []byte("I am probably a secretive secret")
+	img, err := NewImage([]byte("Do I look like a real image to you??"), 6, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, lossless := range []bool{false, true} {
+		expect, err := Encrypt(img, key)
+		if lossless {
+			expect, err = EncryptLossless(img, key)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := EncryptWithOptions(img, key, &EncryptOptions{Lossless: lossless})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equalGob(t, got, expect) {
+			t.Fatalf("lossless %v\nexpect: %v\ngot: %v", lossless, expect, got)
+		}
+		if lossless {
+			continue
+		}
+		got, err = EncryptWithOptions(img, key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equalGob(t, got, expect) {
+			t.Fatalf("nil options\nexpect: %v\ngot: %v", expect, got)
+		}
+	}
+}
+
+func TestCompressOptions(t *testing.T) {
+	enc, _ := testImages(t)
+
+	for _, q := range []uint8{1, 2, 8} {
+		expect, err := Compress(enc, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := CompressWithOptions(enc, q, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equalGob(t, got, expect) {
+			t.Fatalf("q %v\nexpect: %v\ngot: %v", q, expect, got)
+		}
+	}
+
+	expect, err := CompressLossless(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := CompressWithOptions(enc, 1, &CompressOptions{Lossless: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalGob(t, got, expect) {
+		t.Fatalf("\nexpect: %v\ngot: %v", expect, got)
+	}
+	if _, err := CompressWithOptions(enc, 4, &CompressOptions{Lossless: true}); err == nil {
+		t.Fatal("expect error")
+	}
+}
+
+func TestKDF(t *testing.T) {
+	key := []byte("I am probably a secretive secret")
+	payload := make([]byte, 15*9)
+	rand.New(rand.NewSource(1)).Read(payload)
+	img, err := NewImage(payload, 15, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kdf := func(key, salt []byte) []byte {
+		seed := sha256.Sum256(append(append([]byte{}, key...), salt...))
+		return seed[:]
+	}
+
+	var e Encryptor = &EncryptOptions{Lossless: true, KDF: kdf}
+	var c Compressor = &CompressOptions{}
+	var d Decryptor = &DecryptOptions{KDF: kdf}
+	enc, err := e.Encrypt(img, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp, err := c.CompressLossless(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := d.Decrypt(comp, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dec.Image, img.Image) {
+		t.Fatalf("\nexpect: %v\ngot:    %v", img.Image, dec.Image)
+	}
+
+	// The default KDF derives another keystream.
+	if _, err := Decrypt(comp, key); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("\nexpect: %v\ngot: %v", ErrWrongKey, err)
+	}
+
+	opts := &DecryptOptions{KDF: kdf}
+	region, err := opts.DecryptRegion(comp, key, image.Rect(2, 2, 9, 7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 2; y < 7; y++ {
+		if !bytes.Equal(region.Image[(y-2)*region.Width:][:7], img.Image[y*img.Width+2:][:7]) {
+			t.Fatalf("region row %v differs", y)
+		}
+	}
+	preview, err := opts.DecryptPreview(comp, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.At(1, 1) != img.At(2, 2) {
+		t.Fatalf("\nexpect: %v\ngot: %v", img.At(2, 2), preview.At(1, 1))
+	}
+}
+
+func TestKDFInvalidSeed(t *testing.T) {
+	img, err := NewImage(make([]byte, 16), 4, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &EncryptOptions{KDF: func(key, salt []byte) []byte { return key }}
+	if _, err := opts.Encrypt(img, []byte("short")); err == nil {
+		t.Fatal("expect error")
+	}
+}
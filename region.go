@@ -0,0 +1,125 @@
+package gshe
+
+import (
+	"errors"
+	"image"
+	"math/rand"
+)
+
+// Decrypts only the pixels within r of a compressed image.
+// r is in the coordinates of the unpadded image and is cropped to it.
+// The result is the same as cropping the result of Decrypt,
+// but only the blocks around r are unmasked and interpolated.
+func DecryptRegion(img *CompressedImage, key []byte, r image.Rectangle) (*Image, error) {
+	return DecryptRegionWithOptions(img, key, r, nil)
+}
+
+// Same as DecryptRegion with options, see DecryptWithOptions.
+// An Interpolator other than those of this package is given the decrypted
+// blocks around r as the image, and should not look further than 3 blocks
+// away from a pixel for the result to match DecryptWithOptions.
+func DecryptRegionWithOptions(img *CompressedImage, key []byte, r image.Rectangle, opts *DecryptOptions) (*Image, error) {
+	ws := getWorkspace()
+	defer putWorkspace(ws)
+	comp := &compressedImage{}
+	if err := ws.decodeCompressed(comp, img); err != nil {
+		return nil, err
+	}
+	return ws.decryptRegion(comp, key, r, opts)
+}
+
+// Margin in blocks around the region that is decrypted along with it.
+// Blocks near the margin are interpolated as if they were on the border,
+// so the margin must cover everything the region depends on:
+// the window of the estimated thresholds, the neighbours used for their predictions,
+// and the farthest pixels read by any interpolator of this package,
+// once for the interpolation and once again for every refinement.
+func regionMargin(opts *DecryptOptions) int {
+	const reach = 3
+	return thresholdRadius + 1 + reach*(1+opts.Iterations)
+}
+
+// This is the entire region decryption except without fselib decoding.
+func (ws *Workspace) decryptRegion(img *compressedImage, key []byte, r image.Rectangle, opts *DecryptOptions) (*Image, error) {
+	if opts == nil {
+		opts = &DecryptOptions{}
+	}
+
+	w, h := img.Width, img.Height
+	if img.PadWidth {
+		w--
+	}
+	if img.PadHeight {
+		h--
+	}
+	r = r.Intersect(image.Rect(0, 0, w, h))
+	if r.Empty() {
+		return nil, errors.New("region outside of image")
+	}
+
+	// window is the blocks that are decrypted.
+	bw, bh := img.Width/2, img.Height/2
+	margin := regionMargin(opts)
+	window := image.Rect(
+		r.Min.X/2-margin, r.Min.Y/2-margin,
+		(r.Max.X+1)/2+margin, (r.Max.Y+1)/2+margin,
+	).Intersect(image.Rect(0, 0, bw, bh))
+	ww, wh := window.Dx(), window.Dy()
+
+	rng, check, err := newRNG(key, img.Salt, opts.KDF)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkKey(img.KeyCheck, check); err != nil {
+		return nil, err
+	}
+
+	ws.mask = grow(ws.mask, len(img.Quarterimage))
+	mask := ws.mask
+	rng.Read(mask)
+
+	blocks := make([][4]byte, ww*wh)
+	wmask := make([]byte, ww*wh)
+	ws.indices = grow(ws.indices, len(img.Quarterimage))
+	for i, v := range permutation(ws.indices, rand.New(newSource(rng))) {
+		x, y := v%bw-window.Min.X, v/bw-window.Min.Y
+		if x < 0 || y < 0 || x >= ww || y >= wh {
+			continue
+		}
+		blocks[y*ww+x] = img.block(i)
+		wmask[y*ww+x] = mask[v]
+	}
+
+	dec := &Image{}
+	ws.reconstruct(dec, img, blocks, wmask, ww, wh, shiftOptions(opts, 2*window.Min.X, 2*window.Min.Y))
+
+	// Crop r out of the window.
+	ox, oy := 2*window.Min.X, 2*window.Min.Y
+	cropped := make([]byte, 0, r.Dx()*r.Dy())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := (y-oy)*dec.Width - ox
+		cropped = append(cropped, dec.Image[row+r.Min.X:row+r.Max.X]...)
+	}
+	return NewImage(cropped, r.Dx(), r.Dy())
+}
+
+// Returns opts with threshold maps translated by (dx, dy),
+// for interpolating a window of the image as if it were the image.
+func shiftOptions(opts *DecryptOptions, dx, dy int) *DecryptOptions {
+	shift := func(m func(x, y int) int) func(x, y int) int {
+		if m == nil || (dx == 0 && dy == 0) {
+			return m
+		}
+		return func(x, y int) int {
+			return m(x+dx, y+dy)
+		}
+	}
+
+	shifted := *opts
+	shifted.ThresholdMap = shift(opts.ThresholdMap)
+	if c, ok := opts.Interpolator.(CAI); ok {
+		c.ThresholdMap = shift(c.ThresholdMap)
+		shifted.Interpolator = c
+	}
+	return &shifted
+}
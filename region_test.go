@@ -0,0 +1,96 @@
+package gshe
+
+import (
+	"bytes"
+	"image"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestDecryptRegion(t *testing.T) {
+	key := []byte("I am probably a secretive secret")
+
+	// A smooth image with noise so that thresholds differ across the image.
+	w, h := 97, 83
+	r := rand.New(rand.NewSource(1))
+	payload := make([]byte, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := 128 + 80*math.Sin(float64(x)/9)*math.Cos(float64(y)/13) + float64(r.Intn(x/4+1))
+			payload[y*w+x] = byte(v)
+		}
+	}
+	img, err := NewImage(payload, w, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := Encrypt(img, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp, err := Compress(enc, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	optss := []*DecryptOptions{
+		nil,
+		{Iterations: 2},
+		{Interpolator: Bicubic{}},
+		{Interpolator: CAI{ThresholdMap: func(x, y int) int { return x / 4 }}},
+	}
+	rects := []image.Rectangle{
+		image.Rect(40, 30, 57, 45),
+		image.Rect(41, 31, 42, 32),
+		image.Rect(0, 0, 10, 10),
+		image.Rect(80, 70, 120, 100),
+		image.Rect(-5, 20, 97, 21),
+	}
+
+	for i, opts := range optss {
+		full, err := DecryptWithOptions(comp, key, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rect := range rects {
+			got, err := DecryptRegionWithOptions(comp, key, rect, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rect = rect.Intersect(image.Rect(0, 0, w, h))
+			expect := make([]byte, 0, rect.Dx()*rect.Dy())
+			for y := rect.Min.Y; y < rect.Max.Y; y++ {
+				expect = append(expect, full.Image[y*full.Width+rect.Min.X:y*full.Width+rect.Max.X]...)
+			}
+			cropped := make([]byte, 0, len(expect))
+			for y := 0; y < rect.Dy(); y++ {
+				cropped = append(cropped, got.Image[y*got.Width:y*got.Width+rect.Dx()]...)
+			}
+			if !bytes.Equal(cropped, expect) {
+				t.Errorf("options %v region %v:\nexpect: %v\ngot:    %v", i, rect, expect, cropped)
+			}
+		}
+	}
+}
+
+func TestDecryptRegionOutside(t *testing.T) {
+	key := []byte("I am probably a secretive secret")
+
+	img, err := NewImage(make([]byte, 8*6), 8, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := Encrypt(img, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp, err := Compress(enc, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecryptRegion(comp, key, image.Rect(8, 0, 10, 6)); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,261 @@
+// Package server is an HTTP service that compresses encrypted images.
+//
+// The service is meant for the party that compresses without the key.
+// It only ever sees encrypted images, and never needs the key.
+//
+// Endpoints:
+//
+//	POST /compress?q=4        compress an encrypted image with quantization q
+//	POST /compress?lossless=1 compress a losslessly encrypted image without loss
+//	GET  /healthz             report that the server is up
+//	GET  /metrics             report counters in the Prometheus text format
+//
+// The body of /compress is an encrypted image as encoded by MarshalBinary,
+// and the response is the compressed image encoded likewise.
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sinacam/gshe"
+)
+
+// Defaults of Config.
+const (
+	DefaultMaxBodyBytes  = 64 << 20
+	DefaultMaxConcurrent = 4
+)
+
+// ContentType is the content type of encoded images.
+const ContentType = "application/octet-stream"
+
+// Config configures a Server. Zero values are replaced by the defaults.
+type Config struct {
+	// MaxBodyBytes is the largest accepted encrypted image in bytes.
+	MaxBodyBytes int64
+
+	// MaxConcurrent is the number of compressions run at the same time.
+	// Requests beyond it are rejected with 503 Service Unavailable.
+	MaxConcurrent int
+
+	// Compressor compresses the images, gshe.CompressOptions if nil.
+	Compressor gshe.Compressor
+}
+
+// Server is an http.Handler serving the endpoints of the package.
+type Server struct {
+	config  Config
+	mux     *http.ServeMux
+	slots   chan struct{}
+	metrics metrics
+}
+
+// New returns a server with config, which may be nil for the defaults.
+func New(config *Config) *Server {
+	s := &Server{}
+	if config != nil {
+		s.config = *config
+	}
+	if s.config.MaxBodyBytes <= 0 {
+		s.config.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	if s.config.MaxConcurrent <= 0 {
+		s.config.MaxConcurrent = DefaultMaxConcurrent
+	}
+	if s.config.Compressor == nil {
+		s.config.Compressor = &gshe.CompressOptions{}
+	}
+	s.slots = make(chan struct{}, s.config.MaxConcurrent)
+	s.metrics.codes = map[int]uint64{}
+
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("/compress", s.handleCompress)
+	s.mux.HandleFunc("/healthz", s.handleHealth)
+	s.mux.HandleFunc("/metrics", s.handleMetrics)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Parameters of a compression request.
+type params struct {
+	quantization uint8
+	lossless     bool
+}
+
+func parseParams(r *http.Request) (params, error) {
+	var p params
+	q := r.URL.Query()
+	if v := q.Get("lossless"); v != "" {
+		lossless, err := strconv.ParseBool(v)
+		if err != nil {
+			return p, errors.New("invalid lossless")
+		}
+		p.lossless = lossless
+	}
+
+	p.quantization = 1
+	if v := q.Get("q"); v != "" {
+		quantization, err := strconv.ParseUint(v, 10, 8)
+		if err != nil || quantization == 0 || quantization&(quantization-1) != 0 {
+			return p, errors.New("quantization must be power of 2")
+		}
+		p.quantization = uint8(quantization)
+	}
+	if p.lossless && p.quantization != 1 {
+		return p, errors.New("lossless compression has no quantization")
+	}
+	return p, nil
+}
+
+func (s *Server) handleCompress(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	code := s.compressRequest(w, r)
+	s.metrics.observe(code, time.Since(start))
+}
+
+// Serves a compression request and returns the status code.
+func (s *Server) compressRequest(w http.ResponseWriter, r *http.Request) int {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		return httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+	p, err := parseParams(r)
+	if err != nil {
+		return httpError(w, http.StatusBadRequest, err.Error())
+	}
+	if r.ContentLength > s.config.MaxBodyBytes {
+		return httpError(w, http.StatusRequestEntityTooLarge, "image too large")
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	default:
+		w.Header().Set("Retry-After", "1")
+		return httpError(w, http.StatusServiceUnavailable, "too many concurrent requests")
+	}
+	s.metrics.add(&s.metrics.inFlight, 1)
+	defer s.metrics.add(&s.metrics.inFlight, -1)
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, s.config.MaxBodyBytes))
+	s.metrics.add(&s.metrics.bytesReceived, int64(len(body)))
+	if err != nil {
+		if int64(len(body)) >= s.config.MaxBodyBytes {
+			return httpError(w, http.StatusRequestEntityTooLarge, "image too large")
+		}
+		return httpError(w, http.StatusBadRequest, err.Error())
+	}
+
+	enc := &gshe.EncryptedImage{}
+	if err := enc.UnmarshalBinary(body); err != nil {
+		return httpError(w, http.StatusBadRequest, "invalid encrypted image: "+err.Error())
+	}
+
+	var comp *gshe.CompressedImage
+	if p.lossless {
+		comp, err = s.config.Compressor.CompressLossless(enc)
+	} else {
+		comp, err = s.config.Compressor.Compress(enc, p.quantization)
+	}
+	if err != nil {
+		return httpError(w, http.StatusUnprocessableEntity, err.Error())
+	}
+
+	data, err := comp.MarshalBinary()
+	if err != nil {
+		return httpError(w, http.StatusInternalServerError, err.Error())
+	}
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	n, _ := w.Write(data)
+	s.metrics.add(&s.metrics.bytesSent, int64(n))
+	return http.StatusOK
+}
+
+func httpError(w http.ResponseWriter, code int, msg string) int {
+	http.Error(w, msg, code)
+	return code
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, "ok\n")
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.metrics.write(w, s.config.MaxConcurrent)
+}
+
+// metrics are the counters reported by /metrics.
+type metrics struct {
+	mu            sync.Mutex
+	codes         map[int]uint64 // requests by status code
+	duration      time.Duration  // total of all requests
+	inFlight      int64
+	bytesReceived int64
+	bytesSent     int64
+}
+
+func (m *metrics) add(counter *int64, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	*counter += n
+}
+
+func (m *metrics) observe(code int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.codes[code]++
+	m.duration += d
+}
+
+func (m *metrics) write(w io.Writer, maxConcurrent int) {
+	m.mu.Lock()
+	codes := make([]int, 0, len(m.codes))
+	counts := map[int]uint64{}
+	total := uint64(0)
+	for code, n := range m.codes {
+		codes = append(codes, code)
+		counts[code] = n
+		total += n
+	}
+	duration := m.duration
+	inFlight, received, sent := m.inFlight, m.bytesReceived, m.bytesSent
+	m.mu.Unlock()
+	sort.Ints(codes)
+
+	fmt.Fprintln(w, "# HELP gshe_compress_requests_total Compression requests by status code.")
+	fmt.Fprintln(w, "# TYPE gshe_compress_requests_total counter")
+	for _, code := range codes {
+		fmt.Fprintf(w, "gshe_compress_requests_total{code=\"%d\"} %d\n", code, counts[code])
+	}
+	fmt.Fprintln(w, "# HELP gshe_compress_duration_seconds Time spent serving compression requests.")
+	fmt.Fprintln(w, "# TYPE gshe_compress_duration_seconds summary")
+	fmt.Fprintf(w, "gshe_compress_duration_seconds_sum %g\n", duration.Seconds())
+	fmt.Fprintf(w, "gshe_compress_duration_seconds_count %d\n", total)
+	fmt.Fprintln(w, "# HELP gshe_compress_in_flight Compressions currently running.")
+	fmt.Fprintln(w, "# TYPE gshe_compress_in_flight gauge")
+	fmt.Fprintf(w, "gshe_compress_in_flight %d\n", inFlight)
+	fmt.Fprintln(w, "# HELP gshe_compress_max_concurrent Limit of concurrent compressions.")
+	fmt.Fprintln(w, "# TYPE gshe_compress_max_concurrent gauge")
+	fmt.Fprintf(w, "gshe_compress_max_concurrent %d\n", maxConcurrent)
+	fmt.Fprintln(w, "# HELP gshe_received_bytes_total Bytes of encrypted images received.")
+	fmt.Fprintln(w, "# TYPE gshe_received_bytes_total counter")
+	fmt.Fprintf(w, "gshe_received_bytes_total %d\n", received)
+	fmt.Fprintln(w, "# HELP gshe_sent_bytes_total Bytes of compressed images sent.")
+	fmt.Fprintln(w, "# TYPE gshe_sent_bytes_total counter")
+	fmt.Fprintf(w, "gshe_sent_bytes_total %d\n", sent)
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Sinacam/gshe"
+	"github.com/Sinacam/gshe/client"
+)
+
+func testImage(t *testing.T) *gshe.EncryptedImage {
+	key := []byte("I am probably a secretive secret")
+	payload := make([]byte, 15*9)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	img, err := gshe.NewImage(payload, 15, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := gshe.EncryptLossless(img, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return enc
+}
+
+func TestCompress(t *testing.T) {
+	ts := httptest.NewServer(New(nil))
+	defer ts.Close()
+	enc := testImage(t)
+	c := client.New(ts.URL)
+
+	for _, q := range []uint8{1, 4, 16} {
+		got, err := c.Compress(enc, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect, err := gshe.Compress(enc, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotData, _ := got.MarshalBinary()
+		expectData, _ := expect.MarshalBinary()
+		if !bytes.Equal(gotData, expectData) {
+			t.Fatalf("q=%v: compressed images differ", q)
+		}
+	}
+
+	got, err := c.CompressLossless(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.EncResiduals) == 0 {
+		t.Fatal("lossless compression has no residuals")
+	}
+}
+
+// compressorFunc is a Compressor calling itself for both methods.
+type compressorFunc func(*gshe.EncryptedImage, uint8) (*gshe.CompressedImage, error)
+
+func (f compressorFunc) Compress(img *gshe.EncryptedImage, quantization uint8) (*gshe.CompressedImage, error) {
+	return f(img, quantization)
+}
+
+func (f compressorFunc) CompressLossless(img *gshe.EncryptedImage) (*gshe.CompressedImage, error) {
+	return f(img, 1)
+}
+
+func post(t *testing.T, s *Server, target string, body []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body)))
+	return w
+}
+
+func TestBadRequest(t *testing.T) {
+	s := New(nil)
+	body, err := testImage(t).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{"/compress?q=3", "/compress?q=256", "/compress?q=x", "/compress?lossless=1&q=4", "/compress?lossless=x"} {
+		if w := post(t, s, target, body); w.Code != http.StatusBadRequest {
+			t.Fatalf("%v\nexpect: %v\ngot: %v", target, http.StatusBadRequest, w.Code)
+		}
+	}
+	if w := post(t, s, "/compress", []byte("not an image")); w.Code != http.StatusBadRequest {
+		t.Fatalf("\nexpect: %v\ngot: %v", http.StatusBadRequest, w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/compress", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("\nexpect: %v\ngot: %v", http.StatusMethodNotAllowed, w.Code)
+	}
+
+	s = New(&Config{Compressor: compressorFunc(func(*gshe.EncryptedImage, uint8) (*gshe.CompressedImage, error) {
+		return nil, errors.New("failed")
+	})})
+	if w := post(t, s, "/compress", body); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("\nexpect: %v\ngot: %v", http.StatusUnprocessableEntity, w.Code)
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	s := New(&Config{MaxBodyBytes: 100})
+	if w := post(t, s, "/compress", make([]byte, 101)); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("\nexpect: %v\ngot: %v", http.StatusRequestEntityTooLarge, w.Code)
+	}
+
+	// Without a content length the body is cut off while reading.
+	r := httptest.NewRequest(http.MethodPost, "/compress", ioutil.NopCloser(bytes.NewReader(make([]byte, 101))))
+	r.ContentLength = -1
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("\nexpect: %v\ngot: %v", http.StatusRequestEntityTooLarge, w.Code)
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s := New(&Config{MaxConcurrent: 1, Compressor: compressorFunc(func(img *gshe.EncryptedImage, q uint8) (*gshe.CompressedImage, error) {
+		close(started)
+		<-release
+		return gshe.Compress(img, q)
+	})})
+	body, err := testImage(t).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan int)
+	go func() {
+		done <- post(t, s, "/compress", body).Code
+	}()
+	<-started
+
+	w := post(t, s, "/compress", body)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("\nexpect: %v\ngot: %v", http.StatusServiceUnavailable, w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatal("no Retry-After")
+	}
+
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("\nexpect: %v\ngot: %v", http.StatusOK, code)
+	}
+}
+
+func TestHealthAndMetrics(t *testing.T) {
+	s := New(nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("\nexpect: %v\ngot: %v", http.StatusOK, w.Code)
+	}
+
+	body, err := testImage(t).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	post(t, s, "/compress?q=4", body)
+	post(t, s, "/compress?q=3", body)
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	metrics := w.Body.String()
+	for _, line := range []string{
+		`gshe_compress_requests_total{code="200"} 1`,
+		`gshe_compress_requests_total{code="400"} 1`,
+		"gshe_compress_duration_seconds_count 2",
+		"gshe_compress_in_flight 0",
+		"gshe_compress_max_concurrent 4",
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Fatalf("metrics has no %q:\n%v", line, metrics)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+#!/bin/sh
+# Writes the version 0 golden vectors with the app of the first version of
+# gshe, the baseline commit 0f3f60b, built with the real FiniteStateEntropy
+# submodule:
+#
+#	git worktree add /tmp/gshe-v0 0f3f60b
+#	cd /tmp/gshe-v0 && git submodule update --init && go build -o gshe-v0 ./app
+#	testdata/golden/v0/generate.sh /tmp/gshe-v0/gshe-v0
+#
+# Every vector directory holds its key and input.png beforehand.
+# The salt is random, so all outputs of a vector are rewritten together.
+set -e
+app=$1
+cd "$(dirname "$0")"
+for vector in "q1 1" "q4 4"; do
+	set -- $vector
+	# The baseline app does not truncate existing outputs.
+	rm -f "$1/encrypted.gse" "$1/compressed.gsc" "$1/decrypted.png"
+	"$app" -f -e -p "$(cat "$1/key")" -o "$1/encrypted.gse" "$1/input.png"
+	"$app" -f -c -q "$2" -o "$1/compressed.gsc" "$1/encrypted.gse"
+	"$app" -f -d -p "$(cat "$1/key")" -o "$1/decrypted.png" "$1/compressed.gsc"
+done
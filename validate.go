@@ -0,0 +1,89 @@
+package gshe
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// Limits of the dimensions of images, which keep untrusted images
+// from allocating unbounded memory.
+const (
+	MaxDimension = 1 << 16 // width or height
+	MaxPixels    = 1 << 28 // width times height
+)
+
+// Length of the key check.
+const keyCheckSize = 8
+
+// Checks the dimensions of an image padded to multiples of 2.
+func validateDimensions(width, height int) error {
+	switch {
+	case width <= 0 || height <= 0:
+		return fmt.Errorf("%w: %vx%v", ErrInvalidDimensions, width, height)
+	case width%2 != 0 || height%2 != 0:
+		return fmt.Errorf("%w: %vx%v is not padded to multiples of 2", ErrInvalidDimensions, width, height)
+	case width > MaxDimension || height > MaxDimension || int64(width)*int64(height) > MaxPixels:
+		return fmt.Errorf("%w: %vx%v exceeds the maximum", ErrInvalidDimensions, width, height)
+	}
+	return nil
+}
+
+// Checks the dimensions before padding, as given to NewImage.
+func validateUnpadded(width, height int) error {
+	if width <= 0 || height <= 0 {
+		return fmt.Errorf("%w: %vx%v", ErrInvalidDimensions, width, height)
+	}
+	return validateDimensions(width+width%2, height+height%2)
+}
+
+// Validate checks that the data of img matches its dimensions.
+// Every function of the package validates its input images before use,
+// as images read from files or received from others may be crafted.
+func (img *Image) Validate() error {
+	if err := validateDimensions(img.Width, img.Height); err != nil {
+		return err
+	}
+	if len(img.Image) != img.Width*img.Height {
+		return fmt.Errorf("%w: %v bytes of data for %vx%v", ErrInvalidDimensions, len(img.Image), img.Width, img.Height)
+	}
+	return nil
+}
+
+// Validate checks that the sections of img are consistent with its dimensions,
+// so that it can be compressed safely even if it is untrusted.
+func (img *EncryptedImage) Validate() error {
+	if err := validateDimensions(img.Width, img.Height); err != nil {
+		return err
+	}
+	n := img.Width * img.Height / 2
+	switch {
+	case len(img.Halfimage) != n:
+		return corrupt("halfimage", fmt.Errorf("%v bytes for %vx%v", len(img.Halfimage), img.Width, img.Height))
+	case len(img.Antidiagonal) != 0 && len(img.Antidiagonal) != n:
+		return corrupt("antidiagonal", fmt.Errorf("%v bytes for %vx%v", len(img.Antidiagonal), img.Width, img.Height))
+	case len(img.KeyCheck) != 0 && len(img.KeyCheck) != keyCheckSize:
+		return corrupt("key check", fmt.Errorf("%v bytes", len(img.KeyCheck)))
+	}
+	return nil
+}
+
+// Validate checks that the sections of img are consistent with its dimensions,
+// so that it can be decrypted safely even if it is untrusted.
+// The encoded sections are checked further when they are decoded.
+func (img *CompressedImage) Validate() error {
+	if err := validateDimensions(img.Width, img.Height); err != nil {
+		return err
+	}
+	n := img.Width * img.Height / 4
+	switch {
+	case len(img.Quarterimage) != n:
+		return corrupt("quarterimage", fmt.Errorf("%v bytes for %vx%v", len(img.Quarterimage), img.Width, img.Height))
+	case len(img.Qtable) == 0 || len(img.Qtable) > 256 || bits.OnesCount(uint(len(img.Qtable))) != 1:
+		return corrupt("qtable", fmt.Errorf("%v entries", len(img.Qtable)))
+	case len(img.EncResiduals) != 0 && len(img.Qtable) != 256:
+		return corrupt("qtable", fmt.Errorf("%v entries in a lossless image", len(img.Qtable)))
+	case len(img.KeyCheck) != 0 && len(img.KeyCheck) != keyCheckSize:
+		return corrupt("key check", fmt.Errorf("%v bytes", len(img.KeyCheck)))
+	}
+	return nil
+}
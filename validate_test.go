@@ -0,0 +1,124 @@
+package gshe
+
+import (
+	"errors"
+	"testing"
+
+	fselib "github.com/Sinacam/gshe/FiniteStateEntropy/lib"
+)
+
+func TestNewImageInvalid(t *testing.T) {
+	for _, c := range [][3]int{{0, 0, 0}, {1, -1, -1}, {4, -2, -2}, {0, 0, 3}, {0, MaxDimension + 1, 0}} {
+		if _, err := NewImage(make([]byte, c[0]), c[1], c[2]); !errors.Is(err, ErrInvalidDimensions) {
+			t.Fatalf("%vx%v\nexpect: %v\ngot: %v", c[1], c[2], ErrInvalidDimensions, err)
+		}
+	}
+
+	img := &Image{Image: make([]byte, 15), Width: 4, Height: 4}
+	key := []byte("I am probably a secretive secret")
+	if _, err := Encrypt(img, key); !errors.Is(err, ErrInvalidDimensions) {
+		t.Fatalf("\nexpect: %v\ngot: %v", ErrInvalidDimensions, err)
+	}
+}
+
+func TestEncryptedImageInvalid(t *testing.T) {
+	cases := map[string]func(img *EncryptedImage){
+		"zero width":          func(img *EncryptedImage) { img.Width = 0 },
+		"negative height":     func(img *EncryptedImage) { img.Height = -img.Height },
+		"odd width":           func(img *EncryptedImage) { img.Width++ },
+		"huge":                func(img *EncryptedImage) { img.Width, img.Height = MaxDimension, MaxDimension },
+		"odd halfimage":       func(img *EncryptedImage) { img.Halfimage = img.Halfimage[1:] },
+		"short halfimage":     func(img *EncryptedImage) { img.Halfimage = img.Halfimage[:len(img.Halfimage)/2] },
+		"short antidiagonal":  func(img *EncryptedImage) { img.Antidiagonal = img.Antidiagonal[2:] },
+		"truncated key check": func(img *EncryptedImage) { img.KeyCheck = img.KeyCheck[:3] },
+	}
+	for name, mutate := range cases {
+		enc, _ := testImages(t)
+		mutate(enc)
+		if enc.Validate() == nil {
+			t.Fatalf("%v: validated", name)
+		}
+		if _, err := Compress(enc, 1); err == nil {
+			t.Fatalf("%v: compressed", name)
+		}
+		if _, err := CompressLossless(enc); err == nil {
+			t.Fatalf("%v: compressed losslessly", name)
+		}
+		data, err := enc.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := (&EncryptedImage{}).UnmarshalBinary(data); err == nil {
+			t.Fatalf("%v: unmarshalled", name)
+		}
+	}
+}
+
+func TestCompressedImageInvalid(t *testing.T) {
+	// Encodes qdiffs with one out of the range of the qtable.
+	outOfRange := func(img *CompressedImage) {
+		qdiffs, err := img.DecodeQdiffs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		qdiffs[len(qdiffs)/2] = byte(len(img.Qtable))
+		enc := make([]byte, 2*len(qdiffs)+16)
+		n, err := fselib.Encode(enc, qdiffs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img.EncQdiffs = enc[:n]
+	}
+
+	cases := map[string]struct {
+		mutate   func(img *CompressedImage)
+		validate bool // whether Validate detects it, otherwise only decoding does
+	}{
+		"zero height":         {func(img *CompressedImage) { img.Height = 0 }, true},
+		"odd height":          {func(img *CompressedImage) { img.Height-- }, true},
+		"huge":                {func(img *CompressedImage) { img.Width, img.Height = 2, MaxPixels }, true},
+		"grown":               {func(img *CompressedImage) { img.Width += 2 }, true},
+		"short quarterimage":  {func(img *CompressedImage) { img.Quarterimage = img.Quarterimage[1:] }, true},
+		"empty qtable":        {func(img *CompressedImage) { img.Qtable = nil }, true},
+		"odd qtable":          {func(img *CompressedImage) { img.Qtable = img.Qtable[:3] }, true},
+		"long qtable":         {func(img *CompressedImage) { img.Qtable = make([]byte, 512) }, true},
+		"lossless qtable":     {func(img *CompressedImage) { img.Qtable = img.Qtable[:64] }, true},
+		"truncated key check": {func(img *CompressedImage) { img.KeyCheck = img.KeyCheck[:1] }, true},
+		"short qdiffs":        {func(img *CompressedImage) { img.EncQdiffs = img.EncQdiffs[:len(img.EncQdiffs)/2] }, false},
+		"short residuals":     {func(img *CompressedImage) { img.EncResiduals = img.EncResiduals[:len(img.EncResiduals)/2] }, false},
+		"qdiff out of range": {func(img *CompressedImage) {
+			img.EncResiduals = nil
+			img.Qtable = img.Qtable[:64]
+			outOfRange(img)
+		}, false},
+	}
+
+	key := []byte("I am probably a secretive secret")
+	for name, c := range cases {
+		enc, _ := testImages(t)
+		comp, err := CompressLossless(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.mutate(comp)
+		if err := comp.Validate(); (err != nil) != c.validate {
+			t.Fatalf("%v: validate returned %v", name, err)
+		}
+		if _, err := Decrypt(comp, key); err == nil {
+			t.Fatalf("%v: decrypted", name)
+		}
+		if !c.validate {
+			continue
+		}
+		if _, err := DecryptPreview(comp, key); err == nil {
+			t.Fatalf("%v: decrypted preview", name)
+		}
+		data, err := comp.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := (&CompressedImage{}).UnmarshalBinary(data); err == nil {
+			t.Fatalf("%v: unmarshalled", name)
+		}
+	}
+}
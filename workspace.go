@@ -0,0 +1,121 @@
+package gshe
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Workspace keeps the buffers of encryption, compression and decryption
+// between calls, so that processing many images allocates little besides
+// the results, whose buffers the Into methods reuse as well.
+// The zero value is ready to use. A Workspace must not be used concurrently,
+// and its buffers grow to fit the largest image processed.
+type Workspace struct {
+	mask        []byte
+	halves      []byte // both halves of lossless encryption
+	distortions []int
+	qdiffs      []byte
+	residuals   []byte
+	blocks      [][4]byte
+	unpermuted  [][4]byte
+	indices     []int
+	bins        []byte
+	refined     []byte
+	thresholds  thresholdBuffers // of the estimated thresholds of CAI
+}
+
+// The workspaces of the functions without one.
+var workspaces = sync.Pool{
+	New: func() interface{} {
+		return &Workspace{}
+	},
+}
+
+func getWorkspace() *Workspace {
+	return workspaces.Get().(*Workspace)
+}
+
+func putWorkspace(ws *Workspace) {
+	workspaces.Put(ws)
+}
+
+// Returns s resized to n, which is only reallocated if too small.
+// The contents are not cleared.
+func grow[T any](s []T, n int) []T {
+	if cap(s) < n {
+		return make([]T, n)
+	}
+	return s[:n]
+}
+
+// EncryptInto is the same as Encrypt, but writes the result to dst
+// reusing its buffers. dst must not share memory with img.
+func EncryptInto(dst *EncryptedImage, img *Image, key []byte) error {
+	ws := getWorkspace()
+	defer putWorkspace(ws)
+	return ws.EncryptInto(dst, img, key, nil)
+}
+
+// CompressInto is the same as Compress, but writes the result to dst
+// reusing its buffers. The salt and key check of dst are shared with img.
+func CompressInto(dst *CompressedImage, img *EncryptedImage, quantization uint8) error {
+	ws := getWorkspace()
+	defer putWorkspace(ws)
+	return ws.CompressInto(dst, img, quantization, nil)
+}
+
+// DecryptInto is the same as Decrypt, but writes the result to dst
+// reusing its buffer.
+func DecryptInto(dst *Image, img *CompressedImage, key []byte) error {
+	ws := getWorkspace()
+	defer putWorkspace(ws)
+	return ws.DecryptInto(dst, img, key, nil)
+}
+
+// EncryptInto is the same as EncryptWithOptions, but writes the result to dst
+// reusing its buffers. dst must not share memory with img.
+func (ws *Workspace) EncryptInto(dst *EncryptedImage, img *Image, key []byte, opts *EncryptOptions) error {
+	if err := img.Validate(); err != nil {
+		return err
+	}
+	if opts == nil {
+		opts = &EncryptOptions{}
+	}
+	return ws.encrypt(dst, img, key, opts)
+}
+
+// CompressInto is the same as CompressWithOptions, but writes the result to dst
+// reusing its buffers. The salt and key check of dst are shared with img.
+func (ws *Workspace) CompressInto(dst *CompressedImage, img *EncryptedImage, quantization uint8, opts *CompressOptions) error {
+	if err := img.Validate(); err != nil {
+		return err
+	}
+	if opts == nil {
+		opts = &CompressOptions{}
+	}
+
+	comp := &compressedImage{Quarterimage: dst.Quarterimage, Qtable: dst.Qtable}
+	var err error
+	if opts.Lossless {
+		if quantization != 1 {
+			return fmt.Errorf("%w: lossless compression has no quantization", ErrQuantization)
+		}
+		err = ws.compressLossless(comp, img)
+	} else {
+		err = ws.compress(comp, img, quantization)
+	}
+	if err != nil {
+		return err
+	}
+	return encodeCompressed(dst, comp)
+}
+
+// DecryptInto is the same as DecryptWithOptions, but writes the result to dst
+// reusing its buffer.
+func (ws *Workspace) DecryptInto(dst *Image, img *CompressedImage, key []byte, opts *DecryptOptions) error {
+	comp := &compressedImage{}
+	if err := ws.decodeCompressed(comp, img); err != nil {
+		return err
+	}
+	return ws.decrypt(dst, comp, key, opts)
+}
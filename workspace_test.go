@@ -0,0 +1,186 @@
+package gshe
+
+import (
+	"bytes"
+	"runtime"
+	"testing"
+)
+
+func TestInto(t *testing.T) {
+	key := []byte("I am probably a secretive secret")
+	ws := &Workspace{}
+	enc := &EncryptedImage{}
+	comp := &CompressedImage{}
+	dec := &Image{}
+
+	// Large images first, so that the buffers are reused with leftovers.
+	for _, c := range []struct {
+		width, height int
+		lossless      bool
+		quantization  uint8
+		opts          *DecryptOptions
+	}{
+		{31, 17, true, 1, nil},
+		{16, 16, false, 4, &DecryptOptions{Iterations: 2}},
+		{15, 9, true, 8, nil},
+		{6, 4, false, 128, &DecryptOptions{Interpolator: Bilinear{}}},
+	} {
+		payload := make([]byte, c.width*c.height)
+		for i := range payload {
+			payload[i] = byte(i*7 + i*i/13)
+		}
+		img, err := NewImage(payload, c.width, c.height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compOpts := &CompressOptions{Lossless: c.lossless && c.quantization == 1}
+
+		expectEnc, err := EncryptWithOptions(img, key, &EncryptOptions{Lossless: c.lossless})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ws.EncryptInto(enc, img, key, &EncryptOptions{Lossless: c.lossless}); err != nil {
+			t.Fatal(err)
+		}
+		if !equalGob(t, enc, expectEnc) {
+			t.Fatalf("\nexpect: %v\ngot: %v", expectEnc, enc)
+		}
+
+		expectComp, err := CompressWithOptions(enc, c.quantization, compOpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ws.CompressInto(comp, enc, c.quantization, compOpts); err != nil {
+			t.Fatal(err)
+		}
+		if !equalGob(t, comp, expectComp) {
+			t.Fatalf("\nexpect: %v\ngot: %v", expectComp, comp)
+		}
+
+		expectDec, err := DecryptWithOptions(comp, key, c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ws.DecryptInto(dec, comp, key, c.opts); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(dec.Image, expectDec.Image) || dec.Width != expectDec.Width || dec.Height != expectDec.Height ||
+			dec.PadWidth != expectDec.PadWidth || dec.PadHeight != expectDec.PadHeight {
+			t.Fatalf("\nexpect: %v\ngot: %v", expectDec, dec)
+		}
+	}
+}
+
+func TestIntoReuse(t *testing.T) {
+	key := []byte("I am probably a secretive secret")
+	img, err := NewImage(make([]byte, 64*64), 64, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := &EncryptedImage{}
+	comp := &CompressedImage{}
+	dec := &Image{}
+	if err := EncryptInto(enc, img, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := CompressInto(comp, enc, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := DecryptInto(dec, comp, key); err != nil {
+		t.Fatal(err)
+	}
+
+	halfimage, quarterimage, image := &enc.Halfimage[0], &comp.Quarterimage[0], &dec.Image[0]
+	ws := &Workspace{}
+	if err := ws.EncryptInto(enc, img, key, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.CompressInto(comp, enc, 4, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.DecryptInto(dec, comp, key, nil); err != nil {
+		t.Fatal(err)
+	}
+	if &enc.Halfimage[0] != halfimage || &comp.Quarterimage[0] != quarterimage || &dec.Image[0] != image {
+		t.Fatal("buffers were not reused")
+	}
+}
+
+// The allocations remaining with a Workspace are small and independent of
+// the size of the image: deriving the keystream from the key, which makes up
+// nearly all of them, and the closures of the thresholds of CAI.
+// The outputs of the Into methods.
+type intoOutputs struct {
+	enc  EncryptedImage
+	comp CompressedImage
+	dec  Image
+}
+
+func TestIntoAllocs(t *testing.T) {
+	key := []byte("I am probably a secretive secret")
+	for _, size := range []int{64, 512} {
+		img, err := NewImage(make([]byte, size*size), size, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := &intoOutputs{}
+		if err := EncryptInto(&in.enc, img, key); err != nil {
+			t.Fatal(err)
+		}
+		if err := CompressInto(&in.comp, &in.enc, 4); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, c := range []struct {
+			name string
+			f    func(ws *Workspace, out *intoOutputs) error
+		}{
+			{"EncryptInto", func(ws *Workspace, out *intoOutputs) error { return ws.EncryptInto(&out.enc, img, key, nil) }},
+			{"CompressInto", func(ws *Workspace, out *intoOutputs) error { return ws.CompressInto(&out.comp, &in.enc, 4, nil) }},
+			{"DecryptInto", func(ws *Workspace, out *intoOutputs) error { return ws.DecryptInto(&out.dec, &in.comp, key, nil) }},
+			{"DecryptInto refined", func(ws *Workspace, out *intoOutputs) error {
+				return ws.DecryptInto(&out.dec, &in.comp, key, &DecryptOptions{Iterations: 2})
+			}},
+		} {
+			// The counts depend on the version of Go, so only the reuse is checked.
+			ws, out := &Workspace{}, &intoOutputs{}
+			reuse := func() error { return c.f(ws, out) }
+			// The first call grows the buffers.
+			if err := reuse(); err != nil {
+				t.Fatal(err)
+			}
+			reused := testing.AllocsPerRun(10, func() {
+				if err := reuse(); err != nil {
+					t.Fatal(err)
+				}
+			})
+			fresh := testing.AllocsPerRun(10, func() {
+				if err := c.f(&Workspace{}, &intoOutputs{}); err != nil {
+					t.Fatal(err)
+				}
+			})
+			if reused >= fresh {
+				t.Fatalf("%v %vx%v\nexpect: fewer than %v allocations\ngot: %v", c.name, size, size, fresh, reused)
+			}
+			// A buffer of the size of the image is a single allocation, but many bytes.
+			if n := allocatedBytes(t, reuse); n > 4<<10 {
+				t.Fatalf("%v %vx%v\nexpect: at most %v bytes allocated\ngot: %v", c.name, size, size, 4<<10, n)
+			}
+		}
+	}
+}
+
+// Returns the bytes allocated by a call of f on average.
+func allocatedBytes(t *testing.T, f func() error) uint64 {
+	const runs = 10
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < runs; i++ {
+		if err := f(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runtime.ReadMemStats(&after)
+	return (after.TotalAlloc - before.TotalAlloc) / runs
+}